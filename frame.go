@@ -0,0 +1,294 @@
+package go_wsutils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+)
+
+var ErrFrameTooSmall = errors.New("Frame is smaller than its header")
+var ErrFrameVersion = errors.New("Unsupported frame version")
+var ErrFrameFlags = errors.New("Unsupported frame flags")
+var ErrFrameLength = errors.New("Frame length does not match the payload length in its header")
+var ErrPayloadTooLarge = errors.New("Payload is too large for the frame version")
+
+// KNOWN_FRAME_FLAGS are the flags this side understands, frames with any other flag set are rejected
+var KNOWN_FRAME_FLAGS = FRAME_FLAG_CRC32C | FRAME_FLAG_COMPRESSED | FRAME_FLAG_ENCRYPTED
+
+// FrameHeader is the header at the front of every binary packet, the *_HEADER_INDEX_* vars in types.go are the
+// layout it reads and writes. Cmd never carries FRAME_V2_CMD_FLAG - it is added and removed by the codec.
+type FrameHeader struct {
+	SeshID        uint64
+	SeqID         uint64
+	SeshKey       uuid.UUID
+	Cmd           uint16
+	Version       uint8
+	Flags         uint8
+	PayloadLength uint32
+}
+
+func NewFrameHeader(id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, payloadLength int) FrameHeader {
+
+	return FrameHeader{
+		SeshID:        id,
+		SeqID:         seq,
+		SeshKey:       seshKey,
+		Cmd:           cmd,
+		Version:       FRAME_VERSION_1,
+		PayloadLength: uint32(payloadLength),
+	}
+
+}
+
+func NewFrameHeaderV2(id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, flags uint8, payloadLength int) FrameHeader {
+
+	return FrameHeader{
+		SeshID:        id,
+		SeqID:         seq,
+		SeshKey:       seshKey,
+		Cmd:           cmd,
+		Version:       FRAME_VERSION_2,
+		Flags:         flags,
+		PayloadLength: uint32(payloadLength),
+	}
+
+}
+
+// seshKeyString is the key as 32 hex characters, the same as uuid.String without the dashes but with only the one
+// allocation as it runs for every packet
+func seshKeyString(seshKey uuid.UUID) string {
+
+	var buf [32]byte
+
+	hex.Encode(buf[:], seshKey[:])
+
+	return string(buf[:])
+
+}
+
+// parseSeshKey turns a session key from GetSeshKey back into the form carried in the header
+func parseSeshKey(seshKey string) uuid.UUID {
+
+	parsed, _ := uuid.Parse(seshKey)
+	return parsed
+
+}
+
+// SeshKeyString is the session key in the form returned by websocket.Conn.GetSeshKey
+func (h FrameHeader) SeshKeyString() string {
+
+	return seshKeyString(h.SeshKey)
+
+}
+
+// Size is the number of bytes the header takes up on the wire
+func (h FrameHeader) Size() int {
+
+	if h.Version >= FRAME_VERSION_2 {
+		return int(HEADER_SIZE_V2)
+	}
+
+	return int(HEADER_SIZE)
+
+}
+
+func (h FrameHeader) Validate() error {
+
+	switch h.Version {
+	case 0, FRAME_VERSION_1:
+		if h.Flags != 0 {
+			return fmt.Errorf("%w: version 1 frames cannot carry flags", ErrFrameFlags)
+		} else if h.PayloadLength > uint32(MAX_PAYLOAD_SIZE) {
+			return fmt.Errorf("%w: %d bytes is over the limit of %d", ErrPayloadTooLarge, h.PayloadLength, MAX_PAYLOAD_SIZE)
+		}
+	case FRAME_VERSION_2:
+		if h.Flags&^KNOWN_FRAME_FLAGS != 0 {
+			return fmt.Errorf("%w: 0x%02X", ErrFrameFlags, h.Flags)
+		} else if uint64(h.PayloadLength) > uint64(MAX_PAYLOAD_SIZE_V2) {
+			return fmt.Errorf("%w: %d bytes is over the limit of %d", ErrPayloadTooLarge, h.PayloadLength, MAX_PAYLOAD_SIZE_V2)
+		}
+	default:
+		return fmt.Errorf("%w: %d", ErrFrameVersion, h.Version)
+	}
+
+	return nil
+
+}
+
+// AppendBinary appends the encoded header to b
+func (h FrameHeader) AppendBinary(b []byte) ([]byte, error) {
+
+	if err := h.Validate(); err != nil {
+		return b, err
+	}
+
+	start := len(b)
+
+	//grows b in place when it has the capacity, the header bytes are zeroed either way
+	b = append(b, make([]byte, h.Size())...)
+
+	header := b[start:]
+
+	binary.LittleEndian.PutUint64(header[SESH_ID_HEADER_INDEX_START:SESH_ID_HEADER_INDEX_END+1], h.SeshID)
+
+	binary.LittleEndian.PutUint64(header[SEQ_ID_HEADER_INDEX_START:SEQ_ID_HEADER_INDEX_END+1], h.SeqID)
+
+	copy(header[SESH_KEY_HEADER_INDEX_START:SESH_KEY_HEADER_INDEX_END+1], h.SeshKey[:])
+
+	if h.Version >= FRAME_VERSION_2 {
+
+		binary.LittleEndian.PutUint16(header[CMD_ID_HEADER_INDEX_START:CMD_ID_HEADER_INDEX_END+1], h.Cmd|FRAME_V2_CMD_FLAG)
+
+		header[VERSION_HEADER_INDEX_START] = h.Version
+
+		header[FLAGS_HEADER_INDEX_START] = h.Flags
+
+		binary.LittleEndian.PutUint32(header[PAYLOAD_LENGTH_V2_HEADER_INDEX_START:PAYLOAD_LENGTH_V2_HEADER_INDEX_END+1], h.PayloadLength)
+
+	} else {
+
+		binary.LittleEndian.PutUint16(header[CMD_ID_HEADER_INDEX_START:CMD_ID_HEADER_INDEX_END+1], h.Cmd)
+
+		binary.LittleEndian.PutUint16(header[PAYLOAD_LENGTH_HEADER_INDEX_START:PAYLOAD_LENGTH_HEADER_INDEX_END+1], uint16(h.PayloadLength))
+
+	}
+
+	return b, nil
+
+}
+
+func (h FrameHeader) MarshalBinary() ([]byte, error) {
+
+	return h.AppendBinary(make([]byte, 0, h.Size()))
+
+}
+
+// UnmarshalBinary decodes the header from the front of data, anything after the header is ignored
+func (h *FrameHeader) UnmarshalBinary(data []byte) error {
+
+	if len(data) < int(HEADER_SIZE) {
+		return ErrFrameTooSmall
+	}
+
+	h.SeshID = binary.LittleEndian.Uint64(data[SESH_ID_HEADER_INDEX_START : SESH_ID_HEADER_INDEX_END+1])
+
+	h.SeqID = binary.LittleEndian.Uint64(data[SEQ_ID_HEADER_INDEX_START : SEQ_ID_HEADER_INDEX_END+1])
+
+	copy(h.SeshKey[:], data[SESH_KEY_HEADER_INDEX_START:SESH_KEY_HEADER_INDEX_END+1])
+
+	cmd := binary.LittleEndian.Uint16(data[CMD_ID_HEADER_INDEX_START : CMD_ID_HEADER_INDEX_END+1])
+
+	if cmd&FRAME_V2_CMD_FLAG == 0 {
+
+		h.Cmd = cmd
+		h.Version = FRAME_VERSION_1
+		h.Flags = 0
+		h.PayloadLength = uint32(binary.LittleEndian.Uint16(data[PAYLOAD_LENGTH_HEADER_INDEX_START : PAYLOAD_LENGTH_HEADER_INDEX_END+1]))
+
+	} else {
+
+		if len(data) < int(HEADER_SIZE_V2) {
+			return ErrFrameTooSmall
+		}
+
+		h.Cmd = cmd &^ FRAME_V2_CMD_FLAG
+		h.Version = data[VERSION_HEADER_INDEX_START]
+		h.Flags = data[FLAGS_HEADER_INDEX_START]
+		h.PayloadLength = binary.LittleEndian.Uint32(data[PAYLOAD_LENGTH_V2_HEADER_INDEX_START : PAYLOAD_LENGTH_V2_HEADER_INDEX_END+1])
+
+		if h.Version < FRAME_VERSION_2 {
+			return fmt.Errorf("%w: %d", ErrFrameVersion, h.Version)
+		}
+
+	}
+
+	return h.Validate()
+
+}
+
+// IsStreamTerminator reports whether a frame is the 37 byte TRANSFER_COMPLETE marker - a null payload followed by FINAL_BYTE_MARKER
+func IsStreamTerminator(h FrameHeader, payload []byte) bool {
+
+	return h.Version == FRAME_VERSION_1 && h.Cmd == TRANSFER_COMPLETE && h.PayloadLength == 0 && len(payload) == 1 && payload[0] == FINAL_BYTE_MARKER[0]
+
+}
+
+// DecodeFrame splits a binary packet into its header and payload, checking the length recorded in the header
+func DecodeFrame(data []byte) (FrameHeader, []byte, error) {
+
+	var h FrameHeader
+
+	if err := h.UnmarshalBinary(data); err != nil {
+		return h, nil, err
+	}
+
+	payload := data[h.Size():]
+
+	if uint64(len(payload)) != uint64(h.PayloadLength) && !IsStreamTerminator(h, payload) {
+		return h, nil, ErrFrameLength
+	}
+
+	return h, payload, nil
+
+}
+
+// EncodeFrame builds a binary packet from a header and payload, the payload length in the header is set from the payload
+func EncodeFrame(h FrameHeader, payload []byte) ([]byte, error) {
+
+	return AppendFrame(make([]byte, 0, h.Size()+len(payload)), h, payload)
+
+}
+
+// AppendFrame is EncodeFrame appending the packet to b, it does not allocate when b has the capacity for it
+func AppendFrame(b []byte, h FrameHeader, payload []byte) ([]byte, error) {
+
+	h.PayloadLength = uint32(len(payload))
+
+	if len(payload) > MAX_PAYLOAD_SIZE_V2 {
+		return b, ErrPayloadTooLarge
+	}
+
+	packet, err := h.AppendBinary(b)
+
+	if err != nil {
+		return b, err
+	}
+
+	return append(packet, payload...), nil
+
+}
+
+// MaxPooledFrameSize is the largest packet buffer kept for reuse, bigger buffers are left to the garbage collector
+// so one large packet does not pin its memory
+var MaxPooledFrameSize = int(HEADER_SIZE_V2) + 256*1024
+
+// frameBuffers hold the packets being sent, a buffer can go back as soon as WriteMessage returns as the connection
+// has copied the packet into its own write buffer by then
+var frameBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, int(HEADER_SIZE_V2)+DefaultTransferChunkSize)
+		return &b
+	},
+}
+
+func getFrameBuffer() *[]byte {
+
+	return frameBuffers.Get().(*[]byte)
+
+}
+
+// putFrameBuffer returns the buffer with the packet built in it, packet may have outgrown the buffer it started from
+func putFrameBuffer(buf *[]byte, packet []byte) {
+
+	if cap(packet) > MaxPooledFrameSize {
+		return
+	}
+
+	*buf = packet[:0]
+
+	frameBuffers.Put(buf)
+
+}
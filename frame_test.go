@@ -0,0 +1,211 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var testFrameKey = uuid.MustParse("0123456789abcdef0123456789abcdef")
+
+func TestFrameRoundTrip(t *testing.T) {
+
+	payload := []byte("hello frame")
+
+	tests := []struct {
+		name   string
+		header FrameHeader
+		size   int
+	}{
+		{"v1", NewFrameHeader(7, 9, testFrameKey, TRANSFER_CHUNK, len(payload)), int(HEADER_SIZE)},
+		{"v2", NewFrameHeaderV2(7, 9, testFrameKey, TRANSFER_CHUNK, FRAME_FLAG_CRC32C|FRAME_FLAG_COMPRESSED, len(payload)), int(HEADER_SIZE_V2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			packet, err := EncodeFrame(tt.header, payload)
+
+			if err != nil {
+				t.Fatal(err)
+			} else if len(packet) != tt.size+len(payload) {
+				t.Fatalf("packet is %d bytes, expected %d", len(packet), tt.size+len(payload))
+			}
+
+			header, decoded, err := DecodeFrame(packet)
+
+			if err != nil {
+				t.Fatal(err)
+			} else if header != tt.header {
+				t.Fatalf("decoded %+v, expected %+v", header, tt.header)
+			} else if !bytes.Equal(decoded, payload) {
+				t.Fatalf("decoded payload %q", decoded)
+			}
+
+			marshalled, err := tt.header.MarshalBinary()
+
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(marshalled, packet[:tt.size]) {
+				t.Fatal("MarshalBinary does not match the header written by EncodeFrame")
+			}
+
+			var unmarshalled FrameHeader
+
+			if err := unmarshalled.UnmarshalBinary(marshalled); err != nil {
+				t.Fatal(err)
+			} else if unmarshalled != tt.header {
+				t.Fatalf("unmarshalled %+v, expected %+v", unmarshalled, tt.header)
+			}
+
+		})
+	}
+
+}
+
+func TestFrameLayout(t *testing.T) {
+
+	packet, err := EncodeFrame(NewFrameHeaderV2(0x0102, 0x0304, testFrameKey, TRANSFER_CHUNK, FRAME_FLAG_CRC32C, 0), []byte{0xAB})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := binary.LittleEndian.Uint64(packet[0:8]); id != 0x0102 {
+		t.Fatalf("seshID 0x%X", id)
+	} else if seq := binary.LittleEndian.Uint64(packet[8:16]); seq != 0x0304 {
+		t.Fatalf("seqID 0x%X", seq)
+	} else if !bytes.Equal(packet[16:32], testFrameKey[:]) {
+		t.Fatal("session key is not at bytes 16-31")
+	} else if cmd := binary.LittleEndian.Uint16(packet[32:34]); cmd != TRANSFER_CHUNK|FRAME_V2_CMD_FLAG {
+		t.Fatalf("cmd 0x%X", cmd)
+	} else if packet[34] != FRAME_VERSION_2 || packet[35] != FRAME_FLAG_CRC32C {
+		t.Fatalf("version %d flags 0x%X", packet[34], packet[35])
+	} else if length := binary.LittleEndian.Uint32(packet[36:40]); length != 1 {
+		t.Fatalf("payload length %d", length)
+	}
+
+}
+
+func TestFramePayloadLimit(t *testing.T) {
+
+	//the v2 limit comes from a 32 bit length and must not wrap where int is 32 bits wide
+	if MAX_PAYLOAD_SIZE_V2 <= MAX_PAYLOAD_SIZE {
+		t.Fatalf("v2 payload limit is %d", MAX_PAYLOAD_SIZE_V2)
+	}
+
+}
+
+func TestFrameTerminator(t *testing.T) {
+
+	packet, err := NewFrameHeader(3, 12, testFrameKey, TRANSFER_COMPLETE, 0).MarshalBinary()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet = append(packet, FINAL_BYTE_MARKER...)
+
+	if len(packet) != 37 {
+		t.Fatalf("terminator is %d bytes", len(packet))
+	}
+
+	header, payload, err := DecodeFrame(packet)
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !IsStreamTerminator(header, payload) {
+		t.Fatal("terminator was not recognised")
+	} else if header.SeshID != 3 || header.SeqID != 12 {
+		t.Fatalf("terminator decoded as %+v", header)
+	}
+
+}
+
+func TestFrameErrors(t *testing.T) {
+
+	v1, _ := EncodeFrame(NewFrameHeader(1, 1, testFrameKey, TRANSFER_CHUNK, 0), []byte("abc"))
+	v2, _ := EncodeFrame(NewFrameHeaderV2(1, 1, testFrameKey, TRANSFER_CHUNK, 0, 0), []byte("abc"))
+
+	unknownFlags := append([]byte(nil), v2...)
+	unknownFlags[FLAGS_HEADER_INDEX_START] = 0x80
+
+	lowVersion := append([]byte(nil), v2...)
+	lowVersion[VERSION_HEADER_INDEX_START] = FRAME_VERSION_1
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"too small", v1[:HEADER_SIZE-1], ErrFrameTooSmall},
+		{"v2 too small", v2[:HEADER_SIZE], ErrFrameTooSmall},
+		{"v1 short payload", v1[:len(v1)-1], ErrFrameLength},
+		{"v1 long payload", append(append([]byte(nil), v1...), 'd'), ErrFrameLength},
+		{"v2 short payload", v2[:len(v2)-1], ErrFrameLength},
+		{"unknown flags", unknownFlags, ErrFrameFlags},
+		{"v2 command flag with version 1", lowVersion, ErrFrameVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := DecodeFrame(tt.packet); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, expected %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := NewFrameHeaderV2(1, 1, testFrameKey, TRANSFER_CHUNK, 0x80, 0).MarshalBinary(); !errors.Is(err, ErrFrameFlags) {
+		t.Fatalf("marshalling unknown flags got %v", err)
+	}
+
+	header := NewFrameHeader(1, 1, testFrameKey, TRANSFER_CHUNK, 0)
+	header.Flags = FRAME_FLAG_CRC32C
+
+	if _, err := header.MarshalBinary(); !errors.Is(err, ErrFrameFlags) {
+		t.Fatalf("marshalling a v1 header with flags got %v", err)
+	}
+
+}
+
+func BenchmarkAppendFrame(b *testing.B) {
+
+	payload := make([]byte, DefaultTransferChunkSize)
+	header := NewFrameHeaderV2(7, 9, testFrameKey, TRANSFER_CHUNK, FRAME_FLAG_CRC32C, len(payload))
+	buf := make([]byte, 0, int(HEADER_SIZE_V2)+len(payload))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := AppendFrame(buf[:0], header, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+
+	payload := make([]byte, DefaultTransferChunkSize)
+	packet, err := EncodeFrame(NewFrameHeaderV2(7, 9, testFrameKey, TRANSFER_CHUNK, FRAME_FLAG_CRC32C, len(payload)), payload)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := DecodeFrame(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
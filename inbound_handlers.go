@@ -1,106 +1,425 @@
 package go_wsutils
 
 import (
-	"bytes"
-	"encoding/binary"
+	"crypto/cipher"
 	"errors"
+	"fmt"
 	"github.com/768bit/websocket"
 	"github.com/google/uuid"
-	"strings"
+	"time"
 )
 
 func HandleByteStream(socketConn *websocket.Conn, data []byte) error {
 
-	//check the length of the payload it must be a minimum of (8 + 8 + 16 + 2 + 2 + 1) = 37 bytes long...
+	return DefaultTransferManager.HandleByteStream(socketConn, data)
+
+}
 
-	dataReadLen := uint16(len(data))
+func (tm *TransferManager) HandleByteStream(socketConn *websocket.Conn, data []byte) error {
 
-	if dataReadLen < 37 {
+	//check the length of the payload it must be a minimum of (8 + 8 + 16 + 2 + 2 + 1) = 37 bytes long...
+
+	if len(data) < 37 {
 
 		//payload is less than 37 bytes... we will send back an error, the client may have called this incorrectly so we let them know but in effect this packet is completely discarded
 
-		return errors.New("Unable to process byte stream message as it is too small")
+		return SendStreamError(socketConn, 0, 0, parseSeshKey(CurrentSeshKey(socketConn)), FATAL_ERROR, ErrMessageTooSmall)
 
-	} else {
+	}
 
-		//now we need to check what the payload length is marked as... get the 35th and 36th byte...
+	header, payload, err := DecodeFrame(data)
 
-		var seshID uint64
+	if err != nil {
 
-		err := binary.Read(bytes.NewReader(data[SESH_ID_HEADER_INDEX_START:SESH_ID_HEADER_INDEX_END]), binary.LittleEndian, &seshID)
+		//INVALID HEADER OR LENGTHS MISMATCHED... the IDs are still readable so the peer can tell which transfer it broke
 
-		var seqID uint64
+		if IsStreamErrorCmd(header.Cmd) {
+			return fmt.Errorf("%w: %w", ErrPayloadInvalid, err)
+		}
 
-		err = binary.Read(bytes.NewReader(data[SEQ_ID_HEADER_INDEX_START:SEQ_ID_HEADER_INDEX_END]), binary.LittleEndian, &seqID)
+		return SendStreamError(socketConn, header.SeshID, header.SeqID, parseSeshKey(CurrentSeshKey(socketConn)), FATAL_ERROR, fmt.Errorf("%w: %w", ErrPayloadInvalid, err))
 
-		seshKey, err := uuid.FromBytes(data[SESH_KEY_HEADER_INDEX_START:SESH_KEY_HEADER_INDEX_END])
+	}
 
-		seshKeyStr := strings.Replace(seshKey.String(), "-", "", -1)
+	seshKeyStr := header.SeshKeyString()
 
-		if err != nil {
+	if !ValidSeshKey(socketConn, seshKeyStr) && !tm.heldSeshKey(socketConn, header, seshKeyStr) {
 
-			//there was an error getting the session key for this request...
+		//answered with the key the peer sent so it can match the reply to the transfer it belongs to
 
-			return errors.New("Unable to get Session Key from message")
+		if header.Cmd == SESSION_KEY_MISMATCH {
+			//the peer echoes the key it rejected, which is one of ours that has stopped being accepted
+			return tm.ProcessStreamFrame(socketConn, header, payload)
+		} else if IsStreamErrorCmd(header.Cmd) {
+			return ErrSessionKeyMismatch
+		}
 
-		} else if seshKeyStr != socketConn.GetSeshKey() {
+		return SendStreamError(socketConn, header.SeshID, header.SeqID, header.SeshKey, SESSION_KEY_MISMATCH, ErrSessionKeyMismatch)
 
-			return errors.New("Session Key Mismatch")
+	} else if IsStreamTerminator(header, payload) {
 
-		} else {
+		//IS THE TERMINATION MARKER FOR A PAYLOAD (IS A NULL PAYLOAD) - WILL CLEAN UP SUPPLIED SESSION
+		return tm.completeTransfer(socketConn, header.SeshID, header.SeqID, header.SeshKey, seshKeyStr, nil)
 
-			var cmd uint16
+	}
 
-			err = binary.Read(bytes.NewReader(data[CMD_ID_HEADER_INDEX_START:CMD_ID_HEADER_INDEX_END]), binary.LittleEndian, &cmd)
+	//PROCESS THE COMMAND...
+	return tm.ProcessStreamFrame(socketConn, header, payload)
 
-			var payloadSize uint16
+}
 
-			err = binary.Read(bytes.NewReader(data[PAYLOAD_LENGTH_HEADER_INDEX_START:PAYLOAD_LENGTH_HEADER_INDEX_END]), binary.LittleEndian, &payloadSize)
+// ProcessStreamCommand handles a version 1 packet that has already been taken apart, it is kept for existing callers
+// and new code should use ProcessStreamFrame which also takes version 2 headers with their flags
+func ProcessStreamCommand(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, seshKeyStr string, cmd uint16, size uint16, payload []byte) error {
 
-			if dataReadLen == 37 && payloadSize == 0 && data[36] == FINAL_BYTE_MARKER[0] && cmd == TRANSFER_COMPLETE {
-				//IS THE TERMINATION MARKER FOR A PAYLOAD (IS A NULL PAYLOAD) - WILL CLEAN UP SUPPLIED SESSION
-				return nil
-			} else if dataReadLen == payloadSize+HEADER_SIZE {
-				//PROCESS THE COMMAND...
-				return ProcessStreamCommand(socketConn, seshID, seqID, seshKey, seshKeyStr, cmd, payloadSize, data[36:])
-			} else {
+	return DefaultTransferManager.ProcessStreamCommand(socketConn, id, seq, seshKey, seshKeyStr, cmd, size, payload)
 
-				//INVALID PAYLOAD, LENGTHS MISMATCHED...
+}
 
-				return errors.New("Payload invalid")
+func (tm *TransferManager) ProcessStreamCommand(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, seshKeyStr string, cmd uint16, size uint16, payload []byte) error {
 
-			}
+	return tm.ProcessStreamFrame(socketConn, NewFrameHeader(id, seq, seshKey, cmd, int(size)), payload)
 
-		}
+}
 
-	}
+func ProcessStreamFrame(socketConn *websocket.Conn, header FrameHeader, payload []byte) error {
+
+	return DefaultTransferManager.ProcessStreamFrame(socketConn, header, payload)
 
 }
 
-func ProcessStreamCommand(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, seshKeyStr string, cmd uint16, size uint16, payload []byte) error {
+func (tm *TransferManager) ProcessStreamFrame(socketConn *websocket.Conn, header FrameHeader, payload []byte) error {
 
-	//retrieve the session object from cache.. if it doesnt exist the system needs to be able to generate this...
-	// in order for this to happen a session error needs to be responded with...
+	id, seq, seshKey, seshKeyStr, cmd := header.SeshID, header.SeqID, header.SeshKey, header.SeshKeyString(), header.Cmd
 
-	//fullSeshID := seshKeyStr + ":" + fmt.Sprintf("%08")
+	t := tm.Transfer(seshKeyStr, id)
 
 	switch cmd {
 
 	case NEGOTIATE_TRANSFER:
 		//client is requesting to negotiate the transfer...
+
+		if t != nil {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, streamError(TRANSFER_ERROR, StreamErrorIllegalCommand, errors.New("Transfer has already been negotiated")))
+		}
+
+		requested, err := ParseTransferNegotiation(payload)
+
+		if err != nil {
+			return tm.refuseTransfer(socketConn, id, seq, seshKey, err)
+		}
+
+		handler, ok := tm.handler(requested.Purpose)
+
+		if !ok {
+			return tm.refuseTransfer(socketConn, id, seq, seshKey, fmt.Errorf("No transfer handler registered for %q", requested.Purpose))
+		}
+
+		agreed := tm.negotiate(requested)
+
+		ackPayload, err := agreed.MarshalPayload()
+
+		if err != nil {
+			return tm.refuseTransfer(socketConn, id, seq, seshKey, err)
+		}
+
+		var aead cipher.AEAD
+
+		if agreed.Encryption != "" {
+			if aead, err = tm.transferCipher(seshKeyStr, id, agreed); err != nil {
+				return tm.refuseTransfer(socketConn, id, seq, seshKey, err)
+			}
+		}
+
+		//a transfer over the limits is refused before the handler is asked about it
+
+		if err := tm.checkLimits(seshKeyStr, requested); err != nil {
+			return tm.refuseTransfer(socketConn, id, seq, seshKey, streamError(NEGOTIATE_TRANSFER_ERROR, StreamErrorLimit, err))
+		}
+
+		t = NewTransfer(id, seshKeyStr, TransferInbound)
+
+		t.bind(socketConn)
+		t.setNegotiation(agreed)
+		t.setLimits(tm.maxBytes(agreed), agreed.Rate)
+		t.setCipher(aead)
+
+		//the acceptor is handler code and may be slow, so it runs before the lock is taken and every other
+		//negotiation on the manager is left waiting behind it
+
+		if acceptor, ok := handler.(TransferAcceptor); ok {
+			if err := acceptor.AcceptTransfer(t); err != nil {
+				return tm.refuseTransfer(socketConn, id, seq, seshKey, err)
+			}
+		}
+
+		//the limits are checked again and the transfer stored in one step so concurrent negotiations can not both
+		//squeeze in
+
+		tm.limitsMu.Lock()
+
+		if err := tm.checkLimits(seshKeyStr, requested); err != nil {
+			tm.limitsMu.Unlock()
+			return tm.refuseTransfer(socketConn, id, seq, seshKey, streamError(NEGOTIATE_TRANSFER_ERROR, StreamErrorLimit, err))
+		}
+
+		tm.putTransfer(t)
+
+		tm.limitsMu.Unlock()
+
+		if err := SendStreamCmdRequest(socketConn, id, seq, seshKey, NEGOTIATE_TRANSFER_ACK, ackPayload); err != nil {
+			t.fail(err)
+			tm.removeTransfer(t)
+			return err
+		}
+
+		return t.transition(TransferNegotiating, TransferAcked, seq)
+
 	case NEGOTIATE_TRANSFER_ACK:
 		//client is acknowliging that the transfer request has succeeded..
+
+		if t != nil && t.Direction == TransferOutbound {
+
+			agreed, err := ParseTransferNegotiation(payload)
+
+			if err == nil {
+				err = t.Negotiation().accepts(agreed)
+			}
+
+			if err != nil {
+				return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+			}
+
+			t.setNegotiation(agreed)
+
+		}
+
+		return tm.advanceTransfer(socketConn, t, TransferOutbound, TransferNegotiating, TransferAcked, id, seq, seshKey)
+
 	case TRANSFER_BEGIN:
 		//open a transfer using the supplied key, this is the first packet in the sequence and will have a seqID of 0 too
+
+		if err := tm.advanceTransfer(socketConn, t, TransferInbound, TransferAcked, TransferStreaming, id, seq, seshKey); err != nil {
+			return err
+		}
+
+		if err := t.startAssembly(tm.spillThreshold(), tm.SpillDir); err != nil {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+		}
+
+		tm.serveTransfer(t)
+
+		return nil
+
+	case TRANSFER_CHUNK:
+		//a data packet in the sequence, each one is acknowledged back to the sender
+
+		if err := tm.advanceTransfer(socketConn, t, TransferInbound, TransferStreaming, TransferStreaming, id, seq, seshKey); err != nil {
+			return err
+		}
+
+		data, err := t.openChunk(header, payload)
+
+		if chunkSize := t.Metadata().ChunkSize; err == nil && chunkSize > 0 && len(data) > chunkSize {
+			err = fmt.Errorf("Packet %d carries %d bytes but the transfer said it would send at most %d", seq, len(data), chunkSize)
+		}
+
+		received := t.assembler.Received()
+
+		if err != nil {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+		} else if err := t.assembler.Push(seq, data); err != nil {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+		} else if !t.progressed(t.assembler.Received()) {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, ErrTransferCancelled)
+		}
+
+		//holding the ack back slows a peer sending faster than the agreed rate down to its window. Only data the
+		//assembler took is charged, a retransmit of a packet that already arrived is acked straight away, and the
+		//held back ack goes from a timer so the read loop carries on with the other packets on the connection.
+
+		var wait time.Duration
+
+		if added := t.assembler.Received() - received; added > 0 {
+			wait = t.throttle(int(added))
+		}
+
+		if wait > 0 {
+			time.AfterFunc(wait, func() {
+				if t.State() != TransferErrored {
+					SendStreamCmdRequest(socketConn, id, seq, seshKey, TRANSFER_SEQ_ACK, FINAL_BYTE_MARKER)
+				}
+			})
+		} else if err := SendStreamCmdRequest(socketConn, id, seq, seshKey, TRANSFER_SEQ_ACK, FINAL_BYTE_MARKER); err != nil {
+			return err
+		}
+
+		//a late packet may be the one that fills the last gap before the terminator
+		return tm.finishAssembly(socketConn, t, seq, seshKey)
+
+	case TRANSFER_COMPLETE:
+		//the sender has finished, this form of TRANSFER_COMPLETE carries the digest of everything it sent, sealed
+		//like the chunks when encryption was agreed
+
+		digest := payload
+
+		if t != nil && t.Direction == TransferInbound {
+
+			var err error
+
+			if digest, err = t.openDigest(header, payload); err != nil {
+				return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+			}
+
+		}
+
+		return tm.completeTransfer(socketConn, id, seq, seshKey, seshKeyStr, digest)
+
 	case TRANSFER_SEQ_ACK:
 		//we received a packet in the sequence ok (when transmitting to client)
-	case NEGOTIATE_TRANSFER_ERROR:
-		//the client is reporting an error attempting to negotiate the transfer
-	case TRANSFER_ERROR:
-		//the client is reporting that it has encountered and error...
 
+		if err := tm.advanceTransfer(socketConn, t, TransferOutbound, TransferStreaming, TransferStreaming, id, seq, seshKey); err != nil {
+			return err
+		}
+
+		t.ack(seq)
+
+		return nil
+
+	case TRANSFER_RESUME:
+		//the peer lost its connection part way through and wants to carry on, tell it how far we got
+
+		if t == nil {
+			return tm.missingTransfer(socketConn, id, seq, seshKey)
+		} else if state := t.State(); state != TransferAcked && state != TransferStreaming {
+			return tm.rejectTransfer(socketConn, t, id, seq, seshKey, fmt.Errorf("Unable to resume a transfer that is %s", state))
+		}
+
+		if t.Direction == TransferOutbound {
+			//the peer is receiving, whatever it has already written does not need sending again
+			t.ackThrough(seq)
+		}
+
+		t.bind(socketConn)
+
+		return SendStreamCmdRequest(socketConn, id, t.resumePoint(), seshKey, TRANSFER_RESUME_ACK, FINAL_BYTE_MARKER)
+
+	case TRANSFER_RESUME_ACK:
+		//the peer still has the transfer we asked to resume, seq is the last packet it has acknowledged
+
+		if t == nil {
+			return tm.missingTransfer(socketConn, id, seq, seshKey)
+		}
+
+		if t.Direction == TransferOutbound {
+			t.ackThrough(seq)
+		}
+
+		t.resumed(seq)
+
+		return nil
+
+	case SESSION_KEY_ROTATE:
+		//the peer is moving the connection to a new session key, this is not tied to a transfer
+		return tm.acceptSeshKeyRotation(socketConn, header, payload)
+
+	case SESSION_KEY_ROTATE_ACK:
+		return tm.seshKeyRotated(socketConn, header)
+
+	case NEGOTIATE_TRANSFER_ERROR, TRANSFER_ERROR, SESSION_MISSING_ERROR, SESSION_KEY_MISMATCH, FATAL_ERROR:
+		//the client is reporting an error - these are never answered with another error or both sides would bounce them back and forth
+
+		err := ParseStreamError(cmd, payload)
+
+		if t != nil {
+			t.fail(err)
+			tm.removeTransfer(t)
+		}
+
+		return err
+
+	}
+
+	if t != nil {
+		return tm.rejectTransfer(socketConn, t, id, seq, seshKey, streamError(TRANSFER_ERROR, StreamErrorIllegalCommand, fmt.Errorf("Unknown stream command 0x%02X", cmd)))
+	}
+
+	return SendStreamError(socketConn, id, seq, seshKey, FATAL_ERROR, streamError(FATAL_ERROR, StreamErrorIllegalCommand, fmt.Errorf("Unknown stream command 0x%02X", cmd)))
+
+}
+
+func (tm *TransferManager) advanceTransfer(socketConn *websocket.Conn, t *Transfer, direction TransferDirection, from TransferState, to TransferState, id uint64, seq uint64, seshKey uuid.UUID) error {
+
+	if t == nil {
+		return tm.missingTransfer(socketConn, id, seq, seshKey)
+	} else if t.Direction != direction {
+		return tm.rejectTransfer(socketConn, t, id, seq, seshKey, streamError(TRANSFER_ERROR, StreamErrorIllegalCommand, fmt.Errorf("Command is not valid for an %s transfer", t.Direction)))
+	} else if err := t.transition(from, to, seq); err != nil {
+		return tm.rejectTransfer(socketConn, t, id, seq, seshKey, streamError(TRANSFER_ERROR, StreamErrorIllegalCommand, err))
+	}
+
+	return nil
+
+}
+
+func (tm *TransferManager) completeTransfer(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, seshKeyStr string, digest []byte) error {
+
+	t := tm.Transfer(seshKeyStr, id)
+
+	if err := tm.advanceTransfer(socketConn, t, TransferInbound, TransferStreaming, TransferStreaming, id, seq, seshKey); err != nil {
+		return err
+	} else if err := t.assembler.FinishWithDigest(seq, digest); err != nil {
+		return tm.rejectTransfer(socketConn, t, id, seq, seshKey, err)
+	}
+
+	return tm.finishAssembly(socketConn, t, seq, seshKey)
+
+}
+
+// finishAssembly completes the transfer once the assembler has written every packet up to the terminator
+func (tm *TransferManager) finishAssembly(socketConn *websocket.Conn, t *Transfer, seq uint64, seshKey uuid.UUID) error {
+
+	if !t.assembler.Closed() {
+		return nil
+	} else if err := t.assembler.Err(); err != nil {
+		return tm.rejectTransfer(socketConn, t, t.ID, seq, seshKey, err)
+	}
+
+	if err := t.transition(TransferStreaming, TransferComplete, seq); err != nil {
+		return err
+	}
+
+	//the final ack waits on the handler, see serveTransfer
+	tm.removeTransfer(t)
+
+	return nil
+
+}
+
+// missingTransfer tells the peer there is no transfer session for the ID it sent, it will need to negotiate again
+func (tm *TransferManager) missingTransfer(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID) error {
+
+	return SendStreamError(socketConn, id, seq, seshKey, SESSION_MISSING_ERROR, fmt.Errorf("No transfer session has been negotiated for %d", id))
+
+}
+
+// refuseTransfer answers a NEGOTIATE_TRANSFER that could not be accepted, no transfer has been created at this point
+func (tm *TransferManager) refuseTransfer(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, err error) error {
+
+	return SendStreamError(socketConn, id, seq, seshKey, NEGOTIATE_TRANSFER_ERROR, err)
+
+}
+
+// rejectTransfer tells the peer the transfer has failed and drops our side of it
+func (tm *TransferManager) rejectTransfer(socketConn *websocket.Conn, t *Transfer, id uint64, seq uint64, seshKey uuid.UUID, err error) error {
+
+	streamErr := newStreamError(TRANSFER_ERROR, err)
+
+	if t != nil {
+		t.fail(streamErr)
+		tm.removeTransfer(t)
 	}
 
-	return errors.New("Not implemented")
+	return SendStreamError(socketConn, id, seq, seshKey, TRANSFER_ERROR, streamErr)
 
 }
@@ -0,0 +1,97 @@
+package go_wsutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/768bit/websocket"
+	"github.com/google/uuid"
+)
+
+var testSeshKey = uuid.MustParse("00112233445566778899aabbccddeeff")
+
+// loopbackPair connects a client to a server over a real websocket and hands every binary message either end reads
+// to its manager, each end calls DetachConn once its connection drops. Both ends are pinned to testSeshKey through
+// the key ring so the tests do not depend on how the connection was given its key.
+func loopbackPair(tb testing.TB, server *TransferManager, client *TransferManager) (*websocket.Conn, *websocket.Conn) {
+
+	return filteredLoopbackPair(tb, server, client, nil, nil)
+
+}
+
+// filteredLoopbackPair is loopbackPair with a filter on what each end reads, a frame is dropped when its filter
+// returns false. A nil filter keeps everything.
+func filteredLoopbackPair(tb testing.TB, server *TransferManager, client *TransferManager, serverKeep func(header FrameHeader) bool, clientKeep func(header FrameHeader) bool) (*websocket.Conn, *websocket.Conn) {
+
+	upgrader := websocket.Upgrader{}
+	serverConns := make(chan *websocket.Conn, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		pinSeshKey(conn)
+		serverConns <- conn
+
+		serveLoopback(server, conn, serverKeep)
+
+	}))
+
+	tb.Cleanup(srv.Close)
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	pinSeshKey(clientConn)
+
+	go serveLoopback(client, clientConn, clientKeep)
+
+	tb.Cleanup(func() { clientConn.Close() })
+
+	return <-serverConns, clientConn
+
+}
+
+func pinSeshKey(conn *websocket.Conn) {
+
+	connSeshKeys.Store(conn, &seshKeyRing{current: seshKeyString(testSeshKey)})
+
+}
+
+func serveLoopback(tm *TransferManager, conn *websocket.Conn, keep func(header FrameHeader) bool) {
+
+	defer conn.Close()
+	defer tm.DetachConn(conn)
+
+	for {
+
+		messageType, data, err := conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		if keep != nil {
+			if header, _, err := DecodeFrame(data); err == nil && !keep(header) {
+				continue
+			}
+		}
+
+		tm.HandleByteStream(conn, data)
+
+	}
+
+}
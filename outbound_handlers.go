@@ -1,44 +1,170 @@
 package go_wsutils
 
 import (
-	"encoding/binary"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/768bit/websocket"
 	"github.com/google/uuid"
+	"sync"
+	"time"
 )
 
-func SendStreamCmdRequest(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, payload []byte) {
+// gorilla style connections only allow a single writer at a time, so every write in the package takes the
+// connection's lock and the lock is handed out first come first served, which stops a large transfer filling its
+// window from starving the other transfers sharing the connection. The lock is kept until ReleaseConn (or
+// TransferManager.DetachConn) is called for the connection.
+var connWriteLocks sync.Map
+
+func writeMessage(socketConn *websocket.Conn, messageType int, data []byte) error {
+
+	if socketConn == nil {
+		return errors.New("Connection is not available")
+	}
+
+	//the lock is only built the first time a connection is written to
+	lock, ok := connWriteLocks.Load(socketConn)
+
+	if !ok {
+		lock, _ = connWriteLocks.LoadOrStore(socketConn, &fairLock{})
+	}
+
+	lock.(*fairLock).Lock()
+	defer lock.(*fairLock).Unlock()
+
+	return socketConn.WriteMessage(messageType, data)
+
+}
+
+// ReleaseConn forgets the write lock and rotated session keys held for a connection. Every connection written to
+// through the package (SendJSONMessage and SendJSONRequest included) holds on to them until ReleaseConn is called,
+// so it must be called once the connection has closed or they are leaked. TransferManager.DetachConn calls it.
+func ReleaseConn(socketConn *websocket.Conn) {
+
+	connWriteLocks.Delete(socketConn)
+	connSeshKeys.Delete(socketConn)
+
+}
+
+func SendStreamCmdRequest(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, payload []byte) error {
 
 	//send the payload after building the packet...
 
-	var packetHeader []byte = make([]byte, HEADER_SIZE)
+	return SendStreamFrame(socketConn, NewFrameHeader(id, seq, seshKey, cmd, len(payload)), payload)
+
+}
+
+// SendStreamCmdRequestV2 sends a packet with the version 2 header, only use it once the peer has agreed to FRAME_VERSION_2
+func SendStreamCmdRequestV2(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, flags uint8, payload []byte) error {
+
+	return SendStreamFrame(socketConn, NewFrameHeaderV2(id, seq, seshKey, cmd, flags, len(payload)), payload)
+
+}
+
+func SendStreamFrame(socketConn *websocket.Conn, header FrameHeader, payload []byte) error {
+
+	//the packet is built in a pooled buffer so sending does not allocate for every packet
+
+	buf := getFrameBuffer()
+
+	packet, err := AppendFrame(*buf, header, payload)
+
+	if err == nil {
+		err = writeMessage(socketConn, websocket.BinaryMessage, packet)
+	}
+
+	putFrameBuffer(buf, packet)
+
+	return err
+
+}
+
+// SendStreamTerminator sends the 37 byte TRANSFER_COMPLETE marker - a null payload followed by FINAL_BYTE_MARKER
+func SendStreamTerminator(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID) error {
+
+	buf := getFrameBuffer()
+
+	packet, err := NewFrameHeader(id, seq, seshKey, TRANSFER_COMPLETE, 0).AppendBinary(*buf)
+
+	if err == nil {
+		packet = append(packet, FINAL_BYTE_MARKER...)
+		err = writeMessage(socketConn, websocket.BinaryMessage, packet)
+	}
+
+	putFrameBuffer(buf, packet)
+
+	return err
+
+}
+
+// OpenTransfer registers an outbound transfer and asks the peer to negotiate it, the transfer moves on once NEGOTIATE_TRANSFER_ACK arrives
+func (tm *TransferManager) OpenTransfer(socketConn *websocket.Conn, id uint64, seshKey uuid.UUID, negotiation TransferNegotiation) (*Transfer, error) {
 
-	binary.LittleEndian.PutUint64(payload[SESH_ID_HEADER_INDEX_START:SESH_ID_HEADER_INDEX_END], id)
+	seshKeyStr := seshKeyString(seshKey)
 
-	binary.LittleEndian.PutUint64(payload[SEQ_ID_HEADER_INDEX_START:SEQ_ID_HEADER_INDEX_END], id)
+	if tm.Transfer(seshKeyStr, id) != nil {
+		return nil, errors.New("Transfer has already been negotiated")
+	}
+
+	if negotiation.FrameVersion == 0 || negotiation.FrameVersion > tm.maxFrameVersion() {
+		negotiation.FrameVersion = tm.maxFrameVersion()
+	}
+
+	var aead cipher.AEAD
+
+	if negotiation.Encryption != "" {
+
+		if len(negotiation.Salt) == 0 {
+			salt, err := newEncryptionSalt()
+			if err != nil {
+				return nil, err
+			}
+			negotiation.Salt = salt
+		}
+
+		//the peer has to agree to exactly what was offered so the key can be settled before asking
+		var err error
+
+		if aead, err = tm.transferCipher(seshKeyStr, id, negotiation); err != nil {
+			return nil, err
+		}
+
+	}
+
+	payload, err := negotiation.MarshalPayload()
 
-	copy(payload[SESH_KEY_HEADER_INDEX_START:SESH_KEY_HEADER_INDEX_END], socketConn.GetSeshKey())
+	if err != nil {
+		return nil, err
+	}
 
-	binary.LittleEndian.PutUint16(payload[CMD_ID_HEADER_INDEX_START:CMD_ID_HEADER_INDEX_END], cmd)
+	t := NewTransfer(id, seshKeyStr, TransferOutbound)
 
-	binary.LittleEndian.PutUint16(payload[PAYLOAD_LENGTH_HEADER_INDEX_START:PAYLOAD_LENGTH_HEADER_INDEX_END], (uint16)(len(payload)))
+	t.bind(socketConn)
+	t.setNegotiation(negotiation)
+	t.setCipher(aead)
 
-	payload = append(packetHeader, payload...)
+	tm.putTransfer(t)
 
-	socketConn.WriteMessage(websocket.BinaryMessage, payload)
+	if err := SendStreamCmdRequest(socketConn, id, 0, seshKey, NEGOTIATE_TRANSFER, payload); err != nil {
+		t.fail(err)
+		tm.removeTransfer(t)
+		return nil, err
+	}
 
-	//payload written we n
+	return t, nil
 
 }
 
 //send JSON request will send a message to the server for processing - there are several types of JSON message this is the lowest level
+// the write lock taken for conn is kept until ReleaseConn is called for it
 func SendJSONRequest(requestID string, conn *websocket.Conn, payload interface{}, req *WSRequest) {
 
 	encMsg, err := json.Marshal(payload)
 
 	if err == nil {
 
-		if sendErr := conn.WriteMessage(websocket.TextMessage, encMsg); err != nil {
+		if sendErr := writeMessage(conn, websocket.TextMessage, encMsg); sendErr != nil {
 
 			req.Errors = append(req.Errors, sendErr.Error())
 
@@ -63,13 +189,15 @@ func SendJSONRequest(requestID string, conn *websocket.Conn, payload interface{}
 
 }
 
+// SendJSONMessage writes payload to conn as a text message and returns the error if the write failed, the write lock
+// taken for conn is kept until ReleaseConn is called for it
 func SendJSONMessage(conn *websocket.Conn, payload interface{}) error {
 
 	encMsg, err := json.Marshal(payload)
 
 	if err == nil {
 
-		if sendErr := conn.WriteMessage(websocket.TextMessage, encMsg); err != nil {
+		if sendErr := writeMessage(conn, websocket.TextMessage, encMsg); sendErr != nil {
 
 			return sendErr
 
@@ -88,3 +216,61 @@ func SendJSONMessage(conn *websocket.Conn, payload interface{}) error {
 	}
 
 }
+
+// BeginTransfer opens the sequence of an acknowledged outbound transfer, TRANSFER_BEGIN always carries a seqID of 0
+func (tm *TransferManager) BeginTransfer(socketConn *websocket.Conn, t *Transfer, seshKey uuid.UUID) error {
+
+	if t.Direction != TransferOutbound {
+		return errors.New("Only outbound transfers can be begun locally")
+	}
+
+	if err := t.transition(TransferAcked, TransferStreaming, 0); err != nil {
+		return err
+	}
+
+	if err := SendStreamCmdRequest(socketConn, t.ID, 0, seshKey, TRANSFER_BEGIN, FINAL_BYTE_MARKER); err != nil {
+		t.fail(err)
+		tm.removeTransfer(t)
+		return err
+	}
+
+	return nil
+
+}
+
+// ResumeTransfer picks a transfer back up over a new connection after the old one dropped, the peer answers with the
+// last seqID it has acknowledged and an outbound transfer carries on sending from there
+func (tm *TransferManager) ResumeTransfer(socketConn *websocket.Conn, id uint64, seshKey uuid.UUID, timeout time.Duration) (uint64, error) {
+
+	seshKeyStr := seshKeyString(seshKey)
+
+	t := tm.Transfer(seshKeyStr, id)
+
+	if t == nil {
+		return 0, fmt.Errorf("No transfer session to resume for %d", id)
+	} else if state := t.State(); state != TransferAcked && state != TransferStreaming {
+		return 0, fmt.Errorf("Unable to resume a transfer that is %s", state)
+	}
+
+	t.mu.Lock()
+	resumes := t.resumes
+	t.mu.Unlock()
+
+	if err := SendStreamCmdRequest(socketConn, id, t.resumePoint(), seshKey, TRANSFER_RESUME, FINAL_BYTE_MARKER); err != nil {
+		return 0, err
+	}
+
+	if err := t.waitUntil(func() bool { return t.resumes > resumes }, timeout); err != nil {
+		return 0, err
+	}
+
+	//only take the connection over once the peer has confirmed it still has the transfer
+
+	t.bind(socketConn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.resumeSeq, nil
+
+}
@@ -0,0 +1,66 @@
+package go_wsutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/768bit/websocket"
+)
+
+// loopbackConn dials a server that throws away every message it is sent
+func loopbackConn(b *testing.B) *websocket.Conn {
+
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		//NextReader discards whatever was left unread of the previous message
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+
+	}))
+
+	b.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() { conn.Close() })
+
+	return conn
+
+}
+
+func BenchmarkSendStreamFrame(b *testing.B) {
+
+	conn := loopbackConn(b)
+	payload := make([]byte, DefaultTransferChunkSize)
+	header := NewFrameHeaderV2(7, 9, testFrameKey, TRANSFER_CHUNK, FRAME_FLAG_CRC32C, len(payload))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := SendStreamFrame(conn, header, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
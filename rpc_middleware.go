@@ -0,0 +1,133 @@
+package go_wsutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var ErrRPCUnauthorised = errors.New("RPC request is not authorised")
+var ErrRPCPanic = errors.New("RPC handler panicked")
+
+// RPCMiddleware wraps the handler a request is dispatched to, it can work on the request and response around
+// next or answer the request itself without calling next
+type RPCMiddleware func(next RPCHandler) RPCHandler
+
+// Use adds middleware around every handler on the router, including the answer to commands with no handler. The
+// first middleware added is the outermost and so the first to see the request.
+func (r *Router) Use(middleware ...RPCMiddleware) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+
+}
+
+func (r *Router) chain(handler RPCHandler) RPCHandler {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+
+	return handler
+
+}
+
+// RPCAuthMiddleware answers with RPCStatusUnauthorised unless the request has the UserUUID and JWTTicketID set
+// by SetSessionDetails, authorise (when not nil) then decides whether that user may make the request
+func RPCAuthMiddleware(authorise func(ctx context.Context, req *WebSocketRequestBody) error) RPCMiddleware {
+
+	return func(next RPCHandler) RPCHandler {
+		return RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+
+			if req.UserUUID == "" || req.JWTTicketID == "" {
+				return nil, NewRPCError(RPCStatusUnauthorised, fmt.Errorf("%w: no session", ErrRPCUnauthorised))
+			}
+
+			if authorise != nil {
+				if err := authorise(ctx, req); err != nil {
+					return nil, NewRPCError(RPCStatusUnauthorised, fmt.Errorf("%w: %s", ErrRPCUnauthorised, err.Error()))
+				}
+			}
+
+			return next.ServeRPC(ctx, req)
+
+		})
+	}
+
+}
+
+// RPCRecoveryMiddleware turns a panic in the handlers it wraps into an RPCStatusError response, add it first so
+// it also covers the other middleware
+func RPCRecoveryMiddleware() RPCMiddleware {
+
+	return func(next RPCHandler) RPCHandler {
+		return RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (payload interface{}, err error) {
+
+			defer func() {
+				if p := recover(); p != nil {
+					payload = nil
+					err = NewRPCError(RPCStatusError, fmt.Errorf("%w: %v", ErrRPCPanic, p))
+				}
+			}()
+
+			return next.ServeRPC(ctx, req)
+
+		})
+	}
+
+}
+
+// RPCTimingMiddleware calls observe with how long every request took and the error it ended with
+func RPCTimingMiddleware(observe func(req *WebSocketRequestBody, elapsed time.Duration, err error)) RPCMiddleware {
+
+	return func(next RPCHandler) RPCHandler {
+		return RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+
+			started := time.Now()
+
+			payload, err := next.ServeRPC(ctx, req)
+
+			observe(req, time.Since(started), err)
+
+			return payload, err
+
+		})
+	}
+
+}
+
+// RPCLoggingMiddleware logs every request with its outcome through logf, log.Printf when logf is nil
+func RPCLoggingMiddleware(logf func(format string, args ...interface{})) RPCMiddleware {
+
+	if logf == nil {
+		logf = log.Printf
+	}
+
+	return RPCTimingMiddleware(func(req *WebSocketRequestBody, elapsed time.Duration, err error) {
+
+		if err != nil {
+			logf("RPC %s%s (%s) failed after %s: %s", rpcModulePrefix(req.ModuleURI), req.Cmd, req.ID, elapsed, err.Error())
+		} else {
+			logf("RPC %s%s (%s) completed in %s", rpcModulePrefix(req.ModuleURI), req.Cmd, req.ID, elapsed)
+		}
+
+	})
+
+}
+
+func rpcModulePrefix(moduleURI string) string {
+
+	if moduleURI == "" {
+		return ""
+	}
+
+	return moduleURI + " "
+
+}
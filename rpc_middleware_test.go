@@ -0,0 +1,141 @@
+package go_wsutils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+
+	var calls []string
+
+	record := func(name string) RPCMiddleware {
+		return func(next RPCHandler) RPCHandler {
+			return RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+				calls = append(calls, name+" in")
+				payload, err := next.ServeRPC(ctx, req)
+				calls = append(calls, name+" out")
+				return payload, err
+			})
+		}
+	}
+
+	r := NewRouter()
+
+	r.HandleFunc("ping", func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "pong", nil
+	})
+
+	r.Use(record("first"))
+	r.Use(record("second"), record("third"))
+
+	r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, Cmd: "ping"})
+
+	expected := []string{"first in", "second in", "third in", "handler", "third out", "second out", "first out"}
+
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("called %v", calls)
+	}
+
+	//commands with no handler still go through the middleware
+
+	calls = nil
+
+	if resp := r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, Cmd: "missing"}); resp.StatusCode != RPCStatusError {
+		t.Fatalf("status %d", resp.StatusCode)
+	} else if len(calls) != 6 {
+		t.Fatalf("called %v", calls)
+	}
+
+}
+
+func TestRPCRecoveryMiddleware(t *testing.T) {
+
+	r := NewRouter()
+
+	r.HandleFunc("panic", func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+		panic("handler")
+	})
+
+	r.HandleFunc("ping", func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+		return "pong", nil
+	})
+
+	r.Use(RPCRecoveryMiddleware())
+
+	//added after the recovery middleware so it runs inside it
+	r.Use(func(next RPCHandler) RPCHandler {
+		return RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+			if req.Cmd == "ping" {
+				panic("middleware")
+			}
+			return next.ServeRPC(ctx, req)
+		})
+	})
+
+	for _, cmd := range []string{"panic", "ping"} {
+
+		resp := r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, Cmd: cmd})
+
+		if resp.StatusCode != RPCStatusError {
+			t.Fatalf("%s got status %d", cmd, resp.StatusCode)
+		} else if len(resp.Errors) != 1 || !strings.HasPrefix(resp.Errors[0], ErrRPCPanic.Error()) {
+			t.Fatalf("%s got errors %v", cmd, resp.Errors)
+		}
+
+	}
+
+}
+
+func TestRPCAuthMiddleware(t *testing.T) {
+
+	denied := errors.New("denied")
+
+	tests := []struct {
+		name      string
+		session   bool
+		authorise func(ctx context.Context, req *WebSocketRequestBody) error
+		status    int
+	}{
+		{"no session", false, nil, RPCStatusUnauthorised},
+		{"session", true, nil, RPCStatusOK},
+		{"authorised", true, func(ctx context.Context, req *WebSocketRequestBody) error { return nil }, RPCStatusOK},
+		{"refused", true, func(ctx context.Context, req *WebSocketRequestBody) error { return denied }, RPCStatusUnauthorised},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			called := false
+
+			r := NewRouter()
+
+			r.HandleFunc("ping", func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+				called = true
+				return "pong", nil
+			})
+
+			r.Use(RPCAuthMiddleware(tt.authorise))
+
+			req := &WebSocketRequestBody{MessageType: RPCMessage, Cmd: "ping"}
+
+			if tt.session {
+				req.SetSessionDetails("session", "user", "ticket")
+			}
+
+			resp := r.ServeRPC(req)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, expected %d", resp.StatusCode, tt.status)
+			} else if called != (tt.status == RPCStatusOK) {
+				t.Fatalf("handler called %t with status %d", called, resp.StatusCode)
+			}
+
+		})
+	}
+
+}
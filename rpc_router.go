@@ -0,0 +1,204 @@
+package go_wsutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/768bit/websocket"
+	"sync"
+)
+
+var ErrRPCNotFound = errors.New("No RPC handler registered")
+var ErrNotRPCMessage = errors.New("Request is not an RPC message")
+
+// RPCHandler answers an RPCMessage, the payload it returns goes back under "response" with RPCStatusOK and an
+// error goes back in Errors with RPCStatusError, or the status of an RPCError
+type RPCHandler interface {
+	ServeRPC(ctx context.Context, req *WebSocketRequestBody) (interface{}, error)
+}
+
+type RPCHandlerFunc func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error)
+
+func (f RPCHandlerFunc) ServeRPC(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+
+	return f(ctx, req)
+
+}
+
+// RPCError lets a handler choose the status its error is sent back with and the payload that goes with it
+type RPCError struct {
+	StatusCode int
+	Payload    interface{}
+	Err        error
+}
+
+func NewRPCError(statusCode int, err error) *RPCError {
+
+	return &RPCError{StatusCode: statusCode, Err: err}
+
+}
+
+func (e *RPCError) Error() string {
+
+	if e.Err == nil {
+		return fmt.Sprintf("RPC failed with status %d", e.StatusCode)
+	}
+
+	return e.Err.Error()
+
+}
+
+func (e *RPCError) Unwrap() error {
+
+	return e.Err
+
+}
+
+var rpcNotFound = RPCHandlerFunc(func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+
+	return nil, fmt.Errorf("%w for %q", ErrRPCNotFound, req.Cmd)
+
+})
+
+// rpcRoute is where a handler is registered, a handler registered without a module answers the command for any module
+type rpcRoute struct {
+	moduleURI string
+	cmd       string
+}
+
+// Router dispatches RPCMessage requests to the handler registered for their Cmd and ModuleURI
+type Router struct {
+	mu         sync.RWMutex
+	handlers   map[rpcRoute]RPCHandler
+	middleware []RPCMiddleware
+}
+
+func NewRouter() *Router {
+
+	return &Router{
+		handlers: map[rpcRoute]RPCHandler{},
+	}
+
+}
+
+// Handle registers the handler for cmd whatever module the request names, a nil handler removes it
+func (r *Router) Handle(cmd string, handler RPCHandler) {
+
+	r.HandleModule("", cmd, handler)
+
+}
+
+func (r *Router) HandleFunc(cmd string, fn func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error)) {
+
+	r.Handle(cmd, RPCHandlerFunc(fn))
+
+}
+
+// HandleModule registers the handler for cmd on requests with ModuleURI moduleURI, it takes precedence over a
+// handler registered for cmd with Handle
+func (r *Router) HandleModule(moduleURI string, cmd string, handler RPCHandler) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route := rpcRoute{moduleURI: moduleURI, cmd: cmd}
+
+	if handler == nil {
+		delete(r.handlers, route)
+	} else {
+		r.handlers[route] = handler
+	}
+
+}
+
+func (r *Router) HandleModuleFunc(moduleURI string, cmd string, fn func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error)) {
+
+	r.HandleModule(moduleURI, cmd, RPCHandlerFunc(fn))
+
+}
+
+// Handler is the handler a request would be dispatched to
+func (r *Router) Handler(req *WebSocketRequestBody) (RPCHandler, bool) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if handler, ok := r.handlers[rpcRoute{moduleURI: req.ModuleURI, cmd: req.Cmd}]; ok {
+		return handler, true
+	}
+
+	handler, ok := r.handlers[rpcRoute{cmd: req.Cmd}]
+
+	return handler, ok
+
+}
+
+// ServeRPC runs the handler for req through the middleware and builds the response to send back, the handler gets
+// the context of the request (a background context is created for requests without one)
+func (r *Router) ServeRPC(req *WebSocketRequestBody) *WebSocketResponseBody {
+
+	if req.GetContext() == nil {
+		req.CreateContext()
+	}
+
+	handler, ok := r.Handler(req)
+
+	if !ok {
+		handler = rpcNotFound
+	}
+
+	payload, err := r.chain(handler).ServeRPC(req.GetContext(), req)
+
+	return rpcResponse(req, payload, err)
+
+}
+
+// HandleRequest dispatches an RPCMessage that arrived on conn and sends the response back on it, an error means the
+// response was not sent and the caller will not get one
+func (r *Router) HandleRequest(conn *websocket.Conn, req *WebSocketRequestBody) error {
+
+	if req.MessageType != RPCMessage {
+		return fmt.Errorf("%w: message type 0x%02X", ErrNotRPCMessage, req.MessageType)
+	}
+
+	req.SetConn(conn)
+
+	if err := SendJSONMessage(conn, r.ServeRPC(req)); err != nil {
+		return fmt.Errorf("Unable to send the response to %q: %w", req.Cmd, err)
+	}
+
+	return nil
+
+}
+
+func rpcResponse(req *WebSocketRequestBody, payload interface{}, err error) *WebSocketResponseBody {
+
+	var resp *WebSocketResponseBody
+
+	if err == nil {
+
+		resp = NewWebSocketRPCResponseBody(RPCStatusOK, req.SeshKey, req.ID, req.Cmd, payload)
+
+	} else {
+
+		statusCode := RPCStatusError
+
+		var rpcErr *RPCError
+
+		if errors.As(err, &rpcErr) {
+			statusCode = rpcErr.StatusCode
+			if payload == nil {
+				payload = rpcErr.Payload
+			}
+		}
+
+		resp = NewWebSocketRPCErrorResponseBody(statusCode, req.SeshKey, req.ID, req.Cmd, payload, err.Error())
+
+	}
+
+	//the module is echoed so the caller can tell apart commands with the same name in different modules
+	resp.ModuleURI = req.ModuleURI
+
+	return resp
+
+}
@@ -0,0 +1,80 @@
+package go_wsutils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRouterHandleRequest(t *testing.T) {
+
+	r := NewRouter()
+
+	r.HandleFunc("ping", func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+		return "pong", nil
+	})
+
+	serverConn, _ := loopbackPair(t, NewTransferManager(), NewTransferManager())
+
+	if err := r.HandleRequest(serverConn, &WebSocketRequestBody{MessageType: RPCMessage, Cmd: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//the response can not be written once the connection has closed and the caller has to hear about it
+	serverConn.Close()
+
+	if err := r.HandleRequest(serverConn, &WebSocketRequestBody{MessageType: RPCMessage, Cmd: "ping"}); err == nil {
+		t.Fatal("a response that was never sent was reported as sent")
+	}
+
+}
+
+func TestRouterRoutes(t *testing.T) {
+
+	r := NewRouter()
+
+	answer := func(name string) func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+		return func(ctx context.Context, req *WebSocketRequestBody) (interface{}, error) {
+			return name, nil
+		}
+	}
+
+	r.HandleFunc("ping", answer("bare"))
+	r.HandleModuleFunc("files", "ping", answer("files"))
+	r.HandleModuleFunc("users", "ping", answer("users"))
+
+	tests := []struct {
+		moduleURI string
+		cmd       string
+		status    int
+		answer    string
+	}{
+		{"files", "ping", RPCStatusOK, "files"},
+		{"users", "ping", RPCStatusOK, "users"},
+		{"other", "ping", RPCStatusOK, "bare"},
+		{"", "ping", RPCStatusOK, "bare"},
+		{"files", "pong", RPCStatusError, ""},
+	}
+
+	for _, tt := range tests {
+
+		resp := r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, ModuleURI: tt.moduleURI, Cmd: tt.cmd})
+
+		answer, _ := DecodeRPCResponse[string](resp)
+
+		if resp.StatusCode != tt.status || answer != tt.answer {
+			t.Fatalf("%s %s got status %d and %q", tt.moduleURI, tt.cmd, resp.StatusCode, answer)
+		} else if resp.ModuleURI != tt.moduleURI {
+			t.Fatalf("%s %s was answered for module %q", tt.moduleURI, tt.cmd, resp.ModuleURI)
+		}
+
+	}
+
+	//removing the module handler hands its requests back to the bare one
+
+	r.HandleModule("files", "ping", nil)
+
+	if answer, _ := DecodeRPCResponse[string](r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, ModuleURI: "files", Cmd: "ping"})); answer != "bare" {
+		t.Fatalf("got %q", answer)
+	}
+
+}
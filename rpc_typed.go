@@ -0,0 +1,118 @@
+package go_wsutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var ErrRPCPayloadInvalid = errors.New("RPC payload is invalid")
+
+// Validator is implemented by request types that check themselves, Validate is called once the payload has been
+// decoded and an error answers the request with RPCStatusBadRequest
+type Validator interface {
+	Validate() error
+}
+
+// TypedRPCHandler adapts fn to an RPCHandler, the request Payload is decoded into Req with a JSON round trip
+// (a Req of json.RawMessage gets the payload as it is) and the Resp fn returns is sent back under "response"
+func TypedRPCHandler[Req any, Resp any](fn func(ctx context.Context, req Req) (Resp, error)) RPCHandler {
+
+	return RPCHandlerFunc(func(ctx context.Context, body *WebSocketRequestBody) (interface{}, error) {
+
+		var req Req
+
+		if err := DecodeRPCPayload(body, &req); err != nil {
+			return nil, NewRPCError(RPCStatusBadRequest, err)
+		}
+
+		if err := validateRPCRequest(&req); err != nil {
+			return nil, NewRPCError(RPCStatusBadRequest, fmt.Errorf("%w: %s", ErrRPCPayloadInvalid, err.Error()))
+		}
+
+		resp, err := fn(ctx, req)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return resp, nil
+
+	})
+
+}
+
+// HandleTyped registers fn for cmd on r, see TypedRPCHandler
+func HandleTyped[Req any, Resp any](r *Router, cmd string, fn func(ctx context.Context, req Req) (Resp, error)) {
+
+	r.Handle(cmd, TypedRPCHandler(fn))
+
+}
+
+// HandleModuleTyped registers fn for cmd on requests with ModuleURI moduleURI, see TypedRPCHandler
+func HandleModuleTyped[Req any, Resp any](r *Router, moduleURI string, cmd string, fn func(ctx context.Context, req Req) (Resp, error)) {
+
+	r.HandleModule(moduleURI, cmd, TypedRPCHandler(fn))
+
+}
+
+// DecodeRPCPayload decodes the Payload of a request into v
+func DecodeRPCPayload(body *WebSocketRequestBody, v interface{}) error {
+
+	return decodeRPCValue(body.Payload, v)
+
+}
+
+// DecodeRPCResponse decodes what a handler sent back under "response" into Resp, for the side that made the request
+func DecodeRPCResponse[Resp any](body *WebSocketResponseBody) (Resp, error) {
+
+	var resp Resp
+
+	if body.Payload == nil {
+		return resp, nil
+	}
+
+	err := decodeRPCValue(body.Payload["response"], &resp)
+
+	return resp, err
+
+}
+
+func decodeRPCValue(value interface{}, v interface{}) error {
+
+	//the payload has already been through encoding/json once, going back through it gives Req the same
+	//field names, tags and conversions it would have had if it had been decoded straight from the message
+
+	encoded, err := json.Marshal(value)
+
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRPCPayloadInvalid, err.Error())
+	}
+
+	if err := json.Unmarshal(encoded, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrRPCPayloadInvalid, err.Error())
+	}
+
+	return nil
+
+}
+
+// validateRPCRequest runs Validate whether Req implements it on the value or the pointer, a pointer Req left nil by
+// a missing or null payload is refused before Validate or the handler can be called on it
+func validateRPCRequest[Req any](req *Req) error {
+
+	if value := reflect.ValueOf(req).Elem(); value.Kind() == reflect.Pointer && value.IsNil() {
+		return errors.New("no payload was sent")
+	}
+
+	if v, ok := interface{}(req).(Validator); ok {
+		return v.Validate()
+	} else if v, ok := interface{}(*req).(Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+
+}
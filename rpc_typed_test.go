@@ -0,0 +1,78 @@
+package go_wsutils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type greetRequest struct {
+	Name string `json:"name"`
+}
+
+func (g greetRequest) Validate() error {
+
+	if g.Name == "" {
+		return errors.New("name is required")
+	}
+
+	return nil
+
+}
+
+func TestTypedRPCHandler(t *testing.T) {
+
+	called := false
+
+	r := NewRouter()
+
+	HandleTyped(r, "greet", func(ctx context.Context, req greetRequest) (string, error) {
+		called = true
+		return "hello " + req.Name, nil
+	})
+
+	HandleTyped(r, "greetPointer", func(ctx context.Context, req *greetRequest) (string, error) {
+		called = true
+		return "hello " + req.Name, nil
+	})
+
+	tests := []struct {
+		name    string
+		cmd     string
+		payload map[string]interface{}
+		status  int
+		answer  string
+	}{
+		{"decoded", "greet", map[string]interface{}{"name": "world"}, RPCStatusOK, "hello world"},
+		{"decoded pointer", "greetPointer", map[string]interface{}{"name": "world"}, RPCStatusOK, "hello world"},
+		{"wrong type", "greet", map[string]interface{}{"name": 5}, RPCStatusBadRequest, ""},
+		{"invalid", "greet", map[string]interface{}{"name": ""}, RPCStatusBadRequest, ""},
+		{"missing payload", "greetPointer", nil, RPCStatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			called = false
+
+			resp := r.ServeRPC(&WebSocketRequestBody{MessageType: RPCMessage, Cmd: tt.cmd, Payload: tt.payload})
+
+			answer, err := DecodeRPCResponse[string](resp)
+
+			if err != nil {
+				t.Fatal(err)
+			} else if resp.StatusCode != tt.status || answer != tt.answer {
+				t.Fatalf("got status %d and %q", resp.StatusCode, answer)
+			} else if called != (tt.status == RPCStatusOK) {
+				t.Fatalf("handler called %t with status %d", called, resp.StatusCode)
+			}
+
+			if tt.status == RPCStatusBadRequest && (len(resp.Errors) != 1 || !strings.HasPrefix(resp.Errors[0], ErrRPCPayloadInvalid.Error())) {
+				t.Fatalf("got errors %v", resp.Errors)
+			}
+
+		})
+	}
+
+}
@@ -0,0 +1,237 @@
+package go_wsutils
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/768bit/websocket"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// DefaultSeshKeyGrace is how long the old key is still accepted after a rotation for packets already on the wire,
+// transfers that started under the old key carry on using it until they finish
+var DefaultSeshKeyGrace = 30 * time.Second
+
+// the SESSION_KEY_ROTATE payload is the new 16 byte key followed by the grace window in milliseconds as a little endian uint32
+var SESSION_KEY_ROTATE_PAYLOAD_SIZE = 16 + 4
+
+var ErrSeshKeyRotation = errors.New("Session key rotation failed")
+
+// seshKeyRing is the session key of a connection once it has been rotated, before that the key is whatever
+// the connection reports from GetSeshKey
+type seshKeyRing struct {
+	mu         sync.Mutex
+	current    string
+	previous   string
+	graceUntil time.Time
+	acked      chan struct{}
+}
+
+var connSeshKeys sync.Map
+
+func loadSeshKeyRing(socketConn *websocket.Conn) *seshKeyRing {
+
+	ring, ok := connSeshKeys.Load(socketConn)
+
+	if !ok {
+		return nil
+	}
+
+	return ring.(*seshKeyRing)
+
+}
+
+// constantTimeEqual compares keys without giving away how much of a guessed key was right, only its length
+func constantTimeEqual(a string, b string) bool {
+
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+
+}
+
+// CurrentSeshKey is the session key packets on the connection should be sent under
+func CurrentSeshKey(socketConn *websocket.Conn) string {
+
+	if ring := loadSeshKeyRing(socketConn); ring != nil {
+		ring.mu.Lock()
+		defer ring.mu.Unlock()
+		return ring.current
+	}
+
+	return socketConn.GetSeshKey()
+
+}
+
+// ValidSeshKey reports whether a packet carrying seshKey belongs to the connection - it must be the current key or
+// the previous one while its grace window is open
+func ValidSeshKey(socketConn *websocket.Conn, seshKey string) bool {
+
+	ring := loadSeshKeyRing(socketConn)
+
+	if ring == nil {
+		return constantTimeEqual(seshKey, socketConn.GetSeshKey())
+	}
+
+	ring.mu.Lock()
+	current, previous, graceUntil := ring.current, ring.previous, ring.graceUntil
+	ring.mu.Unlock()
+
+	//both keys are always compared so the time taken does not say which one matched
+	isCurrent := constantTimeEqual(seshKey, current)
+	isPrevious := constantTimeEqual(seshKey, previous) && time.Now().Before(graceUntil)
+
+	return isCurrent || isPrevious
+
+}
+
+// heldSeshKey reports whether a packet under a key the connection no longer accepts belongs to a transfer that was
+// opened under that key on the same connection and is still running, such a transfer keeps its key until it finishes
+// rather than being cut off when the grace window of a rotation ends
+func (tm *TransferManager) heldSeshKey(socketConn *websocket.Conn, header FrameHeader, seshKeyStr string) bool {
+
+	if loadSeshKeyRing(socketConn) == nil {
+		//the key has never been rotated so there is no older key a transfer could hold
+		return false
+	}
+
+	t := tm.Transfer(seshKeyStr, header.SeshID)
+
+	if t == nil || t.Conn() != socketConn {
+		return false
+	}
+
+	state := t.State()
+
+	return state != TransferComplete && state != TransferErrored
+
+}
+
+// installSeshKey makes newKey the current key of the connection and keeps the old one for the grace window
+func installSeshKey(socketConn *websocket.Conn, newKey string, grace time.Duration) (string, *seshKeyRing) {
+
+	ring, _ := connSeshKeys.LoadOrStore(socketConn, &seshKeyRing{current: socketConn.GetSeshKey()})
+
+	r := ring.(*seshKeyRing)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldKey := r.current
+
+	r.previous = oldKey
+	r.current = newKey
+	r.graceUntil = time.Now().Add(grace)
+	r.acked = make(chan struct{})
+
+	return oldKey, r
+
+}
+
+// RotateSeshKey moves the connection over to newKey, the peer is told with SESSION_KEY_ROTATE sent under the
+// current key and both keys are accepted for the grace window, after it only transfers already running under the
+// old key may go on using it. It waits for SESSION_KEY_ROTATE_ACK and puts the old key back if the peer does not
+// answer within timeout.
+func (tm *TransferManager) RotateSeshKey(socketConn *websocket.Conn, newKey uuid.UUID, grace time.Duration, timeout time.Duration) error {
+
+	if grace <= 0 {
+		grace = DefaultSeshKeyGrace
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+
+	newKeyStr := seshKeyString(newKey)
+
+	oldKey, ring := installSeshKey(socketConn, newKeyStr, grace)
+
+	ring.mu.Lock()
+	acked := ring.acked
+	ring.mu.Unlock()
+
+	payload := append(make([]byte, 0, SESSION_KEY_ROTATE_PAYLOAD_SIZE), newKey[:]...)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(grace/time.Millisecond))
+
+	err := SendStreamCmdRequest(socketConn, 0, 0, parseSeshKey(oldKey), SESSION_KEY_ROTATE, payload)
+
+	if err == nil {
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-acked:
+			return nil
+		case <-timer.C:
+			err = fmt.Errorf("%w: the peer did not acknowledge the new key", ErrSeshKeyRotation)
+		}
+
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	if ring.current == newKeyStr {
+		ring.current = oldKey
+		ring.previous = ""
+	}
+
+	return err
+
+}
+
+// acceptSeshKeyRotation handles SESSION_KEY_ROTATE from the peer
+func (tm *TransferManager) acceptSeshKeyRotation(socketConn *websocket.Conn, header FrameHeader, payload []byte) error {
+
+	if !tm.AcceptSeshKeyRotation {
+		return SendStreamError(socketConn, header.SeshID, header.SeqID, header.SeshKey, FATAL_ERROR, streamError(FATAL_ERROR, StreamErrorIllegalCommand, fmt.Errorf("%w: rotation is not accepted", ErrSeshKeyRotation)))
+	} else if len(payload) != SESSION_KEY_ROTATE_PAYLOAD_SIZE {
+		return SendStreamError(socketConn, header.SeshID, header.SeqID, header.SeshKey, FATAL_ERROR, fmt.Errorf("%w: %w", ErrPayloadInvalid, ErrSeshKeyRotation))
+	} else if !constantTimeEqual(header.SeshKeyString(), CurrentSeshKey(socketConn)) {
+		//a rotation has to come under the current key, the old one is only good for finishing off what was already sent
+		return SendStreamError(socketConn, header.SeshID, header.SeqID, header.SeshKey, SESSION_KEY_MISMATCH, ErrSessionKeyMismatch)
+	}
+
+	var newKey uuid.UUID
+
+	copy(newKey[:], payload[:16])
+
+	grace := time.Duration(binary.LittleEndian.Uint32(payload[16:])) * time.Millisecond
+
+	oldKey, _ := installSeshKey(socketConn, seshKeyString(newKey), grace)
+
+	if tm.OnSeshKeyRotated != nil {
+		tm.OnSeshKeyRotated(socketConn, oldKey, seshKeyString(newKey))
+	}
+
+	return SendStreamCmdRequest(socketConn, header.SeshID, header.SeqID, newKey, SESSION_KEY_ROTATE_ACK, FINAL_BYTE_MARKER)
+
+}
+
+// seshKeyRotated handles SESSION_KEY_ROTATE_ACK, the peer is confirming it has moved to the key in the header
+func (tm *TransferManager) seshKeyRotated(socketConn *websocket.Conn, header FrameHeader) error {
+
+	ring := loadSeshKeyRing(socketConn)
+
+	if ring == nil {
+		return fmt.Errorf("%w: no rotation is in progress", ErrSeshKeyRotation)
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	if !constantTimeEqual(header.SeshKeyString(), ring.current) {
+		return fmt.Errorf("%w: the peer acknowledged a key that is no longer current", ErrSeshKeyRotation)
+	}
+
+	select {
+	case <-ring.acked:
+	default:
+		close(ring.acked)
+	}
+
+	return nil
+
+}
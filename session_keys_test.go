@@ -0,0 +1,67 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRotateSeshKeyDuringTransfer(t *testing.T) {
+
+	server, client := NewTransferManager(), NewTransferManager()
+	server.AcceptSeshKeyRotation = true
+
+	received := make(chan []byte, 1)
+
+	server.HandleFunc("", func(tr *Transfer, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		received <- data
+		return err
+	})
+
+	_, clientConn := loopbackPair(t, server, client)
+
+	first, second := bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 1000)
+
+	pr, pw := io.Pipe()
+	sent := make(chan error, 1)
+
+	go func() {
+		sent <- client.NewTransferSender(clientConn, 1, testSeshKey).Send(pr)
+	}()
+
+	if _, err := pw.Write(first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.RotateSeshKey(clientConn, uuid.New(), 100*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//the rest of the transfer goes out after the grace window has closed
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := pw.Write(second); err != nil {
+		t.Fatal(err)
+	}
+
+	pw.Close()
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	} else if data := <-received; !bytes.Equal(data, append(first, second...)) {
+		t.Fatalf("received %d bytes", len(data))
+	}
+
+	//the old key only lives on in the transfers that held it, a new one can not be opened under it
+
+	if err := client.NewTransferSender(clientConn, 2, testSeshKey).Send(bytes.NewReader(first)); !errors.Is(err, ErrSessionKeyMismatch) {
+		t.Fatalf("a new transfer under the old key got %v", err)
+	}
+
+}
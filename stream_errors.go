@@ -0,0 +1,206 @@
+package go_wsutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/768bit/websocket"
+	"github.com/google/uuid"
+)
+
+// sentinels for the error commands of the binary protocol, every *StreamError matches the one for its Cmd with errors.Is
+var ErrMessageTooSmall = errors.New("Unable to process byte stream message as it is too small")
+var ErrPayloadInvalid = errors.New("Payload invalid")
+var ErrSessionKeyMismatch = errors.New("Session Key Mismatch")
+var ErrSessionMissing = errors.New("Transfer session missing")
+var ErrTransferError = errors.New("Transfer error")
+var ErrNegotiationRefused = errors.New("Transfer negotiation refused")
+var ErrFatal = errors.New("Fatal stream error")
+
+// reason codes carried in the first two bytes of an error frame payload, the rest of the payload is a UTF-8 description
+const (
+	StreamErrorUnspecified    uint16 = 0x00
+	StreamErrorTooSmall       uint16 = 0x01
+	StreamErrorMalformed      uint16 = 0x02
+	StreamErrorSessionKey     uint16 = 0x03
+	StreamErrorSessionMissing uint16 = 0x04
+	StreamErrorIllegalCommand uint16 = 0x05
+	StreamErrorChecksum       uint16 = 0x06
+	StreamErrorRefused        uint16 = 0x07
+	StreamErrorHandler        uint16 = 0x08
+	StreamErrorTimeout        uint16 = 0x09
+	StreamErrorLimit          uint16 = 0x0A
+	StreamErrorCancelled      uint16 = 0x0B
+	StreamErrorEncryption     uint16 = 0x0C
+)
+
+// reason codes stay below 0x100 so the second byte of a structured payload is always 0, which plain text never is
+var STREAM_ERROR_CODE_SIZE_BYTES = 2
+var MAX_STREAM_ERROR_CODE = (uint16)(0xFF)
+
+// StreamError is an error frame - one we sent to the peer (Err is then the local cause) or one the peer sent us (Remote)
+type StreamError struct {
+	Cmd    uint16
+	Code   uint16
+	Reason string
+	Remote bool
+	Err    error
+}
+
+func newStreamError(cmd uint16, err error) *StreamError {
+
+	var streamErr *StreamError
+
+	if errors.As(err, &streamErr) && (streamErr.Remote || streamErr.Cmd == cmd) {
+		return streamErr
+	}
+
+	return streamError(cmd, streamErrorCode(cmd, err), err)
+
+}
+
+func streamError(cmd uint16, code uint16, err error) *StreamError {
+
+	return &StreamError{Cmd: cmd, Code: code, Reason: err.Error(), Err: err}
+
+}
+
+// streamErrorCode picks the reason code that best describes a local error
+func streamErrorCode(cmd uint16, err error) uint16 {
+
+	switch {
+	case errors.Is(err, ErrMessageTooSmall), errors.Is(err, ErrFrameTooSmall):
+		return StreamErrorTooSmall
+	case errors.Is(err, ErrChecksumMismatch):
+		return StreamErrorChecksum
+	case errors.Is(err, ErrLimitExceeded), errors.Is(err, ErrTransferIncomplete):
+		return StreamErrorLimit
+	case errors.Is(err, ErrTransferCancelled), errors.Is(err, ErrSessionEnded):
+		return StreamErrorCancelled
+	case errors.Is(err, ErrTransferExpired):
+		return StreamErrorTimeout
+	case errors.Is(err, ErrEncryptionUnavailable), errors.Is(err, ErrDecryptionFailed):
+		return StreamErrorEncryption
+	case errors.Is(err, ErrPayloadInvalid), errors.Is(err, ErrFrameVersion), errors.Is(err, ErrFrameFlags),
+		errors.Is(err, ErrFrameLength), errors.Is(err, ErrPayloadTooLarge):
+		return StreamErrorMalformed
+	}
+
+	switch cmd {
+	case SESSION_KEY_MISMATCH:
+		return StreamErrorSessionKey
+	case SESSION_MISSING_ERROR:
+		return StreamErrorSessionMissing
+	case NEGOTIATE_TRANSFER_ERROR:
+		return StreamErrorRefused
+	}
+
+	return StreamErrorUnspecified
+
+}
+
+// ParseStreamError decodes the payload of an error frame, payloads from peers that predate the reason code are taken
+// to be the reason on its own
+func ParseStreamError(cmd uint16, payload []byte) *StreamError {
+
+	e := &StreamError{Cmd: cmd, Code: StreamErrorUnspecified, Remote: true}
+
+	if len(payload) >= STREAM_ERROR_CODE_SIZE_BYTES && payload[1] == 0 {
+		e.Code = binary.LittleEndian.Uint16(payload[:STREAM_ERROR_CODE_SIZE_BYTES])
+		e.Reason = string(payload[STREAM_ERROR_CODE_SIZE_BYTES:])
+	} else if len(payload) != len(FINAL_BYTE_MARKER) || payload[0] != FINAL_BYTE_MARKER[0] {
+		e.Reason = string(payload)
+	}
+
+	return e
+
+}
+
+// MarshalPayload encodes the reason code and description sent in an error frame
+func (e *StreamError) MarshalPayload() []byte {
+
+	code := e.Code
+
+	if code > MAX_STREAM_ERROR_CODE {
+		code = StreamErrorUnspecified
+	}
+
+	reason := e.Reason
+
+	if len(reason) > MAX_PAYLOAD_SIZE-STREAM_ERROR_CODE_SIZE_BYTES {
+		reason = reason[:MAX_PAYLOAD_SIZE-STREAM_ERROR_CODE_SIZE_BYTES]
+	}
+
+	payload := binary.LittleEndian.AppendUint16(make([]byte, 0, STREAM_ERROR_CODE_SIZE_BYTES+len(reason)), code)
+
+	return append(payload, reason...)
+
+}
+
+func (e *StreamError) Error() string {
+
+	if e.Remote {
+		return fmt.Sprintf("Peer reported %s (0x%02X): %s", streamErrorSentinel(e.Cmd), e.Code, e.Reason)
+	}
+
+	return e.Reason
+
+}
+
+func (e *StreamError) Is(target error) bool {
+
+	return target == streamErrorSentinel(e.Cmd)
+
+}
+
+func (e *StreamError) Unwrap() error {
+
+	return e.Err
+
+}
+
+func streamErrorSentinel(cmd uint16) error {
+
+	switch cmd {
+	case SESSION_KEY_MISMATCH:
+		return ErrSessionKeyMismatch
+	case SESSION_MISSING_ERROR:
+		return ErrSessionMissing
+	case TRANSFER_ERROR:
+		return ErrTransferError
+	case NEGOTIATE_TRANSFER_ERROR:
+		return ErrNegotiationRefused
+	case FATAL_ERROR:
+		return ErrFatal
+	}
+
+	return ErrTransferError
+
+}
+
+// IsStreamErrorCmd reports whether cmd is one of the error commands, they are never answered with another error frame
+// or both sides would bounce them back and forth
+func IsStreamErrorCmd(cmd uint16) bool {
+
+	switch cmd {
+	case NEGOTIATE_TRANSFER_ERROR, TRANSFER_ERROR, SESSION_MISSING_ERROR, SESSION_KEY_MISMATCH, FATAL_ERROR:
+		return true
+	}
+
+	return false
+
+}
+
+// SendStreamError replies to the peer with an error frame and returns the error that was sent, nothing is sent when
+// err came from the peer in the first place
+func SendStreamError(socketConn *websocket.Conn, id uint64, seq uint64, seshKey uuid.UUID, cmd uint16, err error) *StreamError {
+
+	streamErr := newStreamError(cmd, err)
+
+	if !streamErr.Remote {
+		SendStreamCmdRequest(socketConn, id, seq, seshKey, cmd, streamErr.MarshalPayload())
+	}
+
+	return streamErr
+
+}
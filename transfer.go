@@ -0,0 +1,630 @@
+package go_wsutils
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"github.com/768bit/websocket"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TransferState int
+
+const (
+	TransferNegotiating TransferState = iota
+	TransferAcked
+	TransferStreaming
+	TransferComplete
+	TransferErrored
+)
+
+func (s TransferState) String() string {
+
+	switch s {
+	case TransferNegotiating:
+		return "negotiating"
+	case TransferAcked:
+		return "acked"
+	case TransferStreaming:
+		return "streaming"
+	case TransferComplete:
+		return "complete"
+	case TransferErrored:
+		return "errored"
+	}
+
+	return fmt.Sprintf("TransferState(%d)", int(s))
+
+}
+
+// the legal moves of the transfer state machine, streaming may loop on itself as each packet in the sequence arrives
+var transferTransitions = map[TransferState][]TransferState{
+	TransferNegotiating: {TransferAcked, TransferErrored},
+	TransferAcked:       {TransferStreaming, TransferErrored},
+	TransferStreaming:   {TransferStreaming, TransferComplete, TransferErrored},
+}
+
+type TransferDirection int
+
+const (
+	TransferInbound TransferDirection = iota
+	TransferOutbound
+)
+
+func (d TransferDirection) String() string {
+
+	if d == TransferOutbound {
+		return "outbound"
+	}
+
+	return "inbound"
+
+}
+
+// TransferKey builds the identifier a transfer is registered under - the session key of the connection plus the session ID carried in the packet header
+func TransferKey(seshKey string, id uint64) string {
+
+	//the same as fmt.Sprintf("%s:%016x", seshKey, id) without the allocations, it is built for every packet
+
+	var sb strings.Builder
+
+	sb.Grow(len(seshKey) + 17)
+	sb.WriteString(seshKey)
+	sb.WriteByte(':')
+
+	for shift := 60; shift >= 0; shift -= 4 {
+		sb.WriteByte("0123456789abcdef"[(id>>uint(shift))&0x0F])
+	}
+
+	return sb.String()
+
+}
+
+type Transfer struct {
+	ID          uint64
+	SeshKey     string
+	Direction   TransferDirection
+	mu          sync.Mutex
+	state       TransferState
+	seq         uint64
+	err         error
+	conn        *websocket.Conn
+	negotiation TransferNegotiation
+	assembler   *TransferAssembler
+	reader      io.ReadCloser
+	resumes     int
+	resumeSeq   uint64
+	acked       uint64
+	ackedSet    map[uint64]struct{}
+	notify      chan struct{}
+	maxBytes    int64
+	limiter     *rateLimiter
+	progress    *transferProgress
+	aead        cipher.AEAD
+	created     time.Time
+	updated     time.Time
+}
+
+func NewTransfer(id uint64, seshKey string, direction TransferDirection) *Transfer {
+
+	now := time.Now()
+
+	return &Transfer{
+		ID:        id,
+		SeshKey:   seshKey,
+		Direction: direction,
+		state:     TransferNegotiating,
+		ackedSet:  map[uint64]struct{}{},
+		notify:    make(chan struct{}),
+		created:   now,
+		updated:   now,
+	}
+
+}
+
+func (t *Transfer) Key() string {
+
+	return TransferKey(t.SeshKey, t.ID)
+
+}
+
+func (t *Transfer) State() TransferState {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+
+}
+
+// Seq is the last sequence ID that moved the transfer along
+func (t *Transfer) Seq() uint64 {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.seq
+
+}
+
+// LastActive is when the transfer last changed state, stores use it to expire abandoned transfers
+func (t *Transfer) LastActive() time.Time {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.updated
+
+}
+
+func (t *Transfer) Err() error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+
+}
+
+// Conn is the connection the transfer is currently running over, it is nil while the transfer waits to be resumed
+func (t *Transfer) Conn() *websocket.Conn {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+
+}
+
+func (t *Transfer) bind(socketConn *websocket.Conn) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conn = socketConn
+	t.updated = time.Now()
+	t.broadcast()
+
+}
+
+// detach drops the connection if it is still the one the transfer is bound to
+func (t *Transfer) detach(socketConn *websocket.Conn) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == socketConn {
+		t.conn = nil
+		t.broadcast()
+	}
+
+}
+
+// resumePoint is the last seqID this side can vouch for - everything the assembler has written for an inbound
+// transfer or everything the peer has acknowledged for an outbound one
+func (t *Transfer) resumePoint() uint64 {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.Direction == TransferOutbound {
+		return t.acked
+	} else if t.assembler != nil {
+		return t.assembler.Next() - 1
+	}
+
+	return 0
+
+}
+
+func (t *Transfer) resumed(seq uint64) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.resumes++
+	t.resumeSeq = seq
+	t.broadcast()
+
+}
+
+// Negotiation is what was offered for an outbound transfer until NEGOTIATE_TRANSFER_ACK arrives, and what was agreed after
+func (t *Transfer) Negotiation() TransferNegotiation {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.negotiation
+
+}
+
+func (t *Transfer) setNegotiation(negotiation TransferNegotiation) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.negotiation = negotiation
+
+}
+
+// Metadata describes the transfer as its sender did in NEGOTIATE_TRANSFER, anything the sender left out that was
+// negotiated anyway (the size and digest) is filled in
+func (t *Transfer) Metadata() TransferMetadata {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta := TransferMetadata{}
+
+	if t.negotiation.Metadata != nil {
+		meta = *t.negotiation.Metadata
+	}
+
+	if meta.Size == 0 {
+		meta.Size = t.negotiation.Size
+	}
+
+	if meta.Checksum == "" {
+		meta.Checksum = t.negotiation.Digest
+	}
+
+	return meta
+
+}
+
+// Reader streams the reassembled data of an inbound transfer, it is nil until TRANSFER_BEGIN has been received
+func (t *Transfer) Reader() io.ReadCloser {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reader
+
+}
+
+// startAssembly sets up the assembler for an inbound transfer, data its handler has not read yet is spilled to a
+// temporary file in spillDir beyond spillThreshold bytes and no more than that (DefaultSpillThreshold when nothing is
+// spilled) may wait on a gap
+func (t *Transfer) startAssembly(spillThreshold int64, spillDir string) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.assembler != nil {
+		return nil
+	}
+
+	t.assembler, t.reader = NewTransferAssemblerSpillReader(spillThreshold, spillDir)
+	t.assembler.SetLimit(t.maxBytes)
+
+	//packets held on a gap stay in memory, they are capped like the data waiting on the handler
+
+	if spillThreshold > 0 {
+		t.assembler.SetPendingLimit(spillThreshold)
+	} else {
+		t.assembler.SetPendingLimit(DefaultSpillThreshold)
+	}
+
+	if t.negotiation.Size > 0 {
+		t.assembler.ExpectSize(t.negotiation.Size)
+	}
+
+	if t.negotiation.Digest != "" {
+		return t.assembler.EnableDigest(t.negotiation.Digest)
+	}
+
+	return nil
+
+}
+
+// setLimits applies the size cap and rate agreed for an inbound transfer
+func (t *Transfer) setLimits(maxBytes int64, rate int64) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxBytes = maxBytes
+	t.limiter = newRateLimiter(rate)
+
+}
+
+// throttle books n bytes against the agreed rate and returns how long to hold them back
+func (t *Transfer) throttle(n int) time.Duration {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(t.limiter.reserve(n))
+
+}
+
+func (t *Transfer) transition(from TransferState, to TransferState, seq uint64) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != from {
+		return fmt.Errorf("Transfer is %s, expected it to be %s", t.state, from)
+	}
+
+	for _, allowed := range transferTransitions[t.state] {
+		if allowed == to {
+			t.state = to
+			t.seq = seq
+			t.updated = time.Now()
+			t.broadcast()
+			if to == TransferComplete {
+				t.progress.finish(nil)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Illegal transfer transition from %s to %s", t.state, to)
+
+}
+
+func (t *Transfer) fail(err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == TransferComplete || t.state == TransferErrored {
+		return
+	}
+
+	t.state = TransferErrored
+	t.err = err
+	t.updated = time.Now()
+	t.broadcast()
+	t.progress.finish(err)
+
+	if t.assembler != nil {
+		t.assembler.Abort(err)
+	}
+
+}
+
+// failedWith reports whether the transfer has failed, or its data failed to assemble with err, in which case the
+// transfer is already being rejected with it
+func (t *Transfer) failedWith(err error) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == TransferErrored {
+		return true
+	}
+
+	if t.assembler != nil {
+		if assemblyErr := t.assembler.Err(); assemblyErr != nil && errors.Is(err, assemblyErr) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Acked is the highest seqID for which it and every packet before it have been acknowledged by the peer
+func (t *Transfer) Acked() uint64 {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.acked
+
+}
+
+func (t *Transfer) ack(seq uint64) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if seq <= t.acked {
+		return
+	}
+
+	t.ackedSet[seq] = struct{}{}
+
+	for {
+		if _, ok := t.ackedSet[t.acked+1]; !ok {
+			break
+		}
+		delete(t.ackedSet, t.acked+1)
+		t.acked++
+	}
+
+	t.broadcast()
+
+}
+
+func (t *Transfer) isAcked(seq uint64) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if seq <= t.acked {
+		return true
+	}
+
+	_, ok := t.ackedSet[seq]
+
+	return ok
+
+}
+
+// changed returns a channel that is closed the next time the transfer changes
+func (t *Transfer) changed() <-chan struct{} {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.notify
+
+}
+
+// ackThrough treats every seqID up to and including seq as acknowledged
+func (t *Transfer) ackThrough(seq uint64) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if seq <= t.acked {
+		return
+	}
+
+	t.acked = seq
+
+	for acked := range t.ackedSet {
+		if acked <= seq {
+			delete(t.ackedSet, acked)
+		}
+	}
+
+	for {
+		if _, ok := t.ackedSet[t.acked+1]; !ok {
+			break
+		}
+		delete(t.ackedSet, t.acked+1)
+		t.acked++
+	}
+
+	t.broadcast()
+
+}
+
+// broadcast wakes everything in waitUntil, t.mu must be held
+func (t *Transfer) broadcast() {
+
+	close(t.notify)
+	t.notify = make(chan struct{})
+
+}
+
+// waitUntil blocks until cond (called with t.mu held) is true, the transfer fails or the timeout passes
+func (t *Transfer) waitUntil(cond func() bool, timeout time.Duration) error {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+
+		t.mu.Lock()
+
+		if t.state == TransferErrored {
+			err := t.err
+			t.mu.Unlock()
+			return err
+		} else if cond() {
+			t.mu.Unlock()
+			return nil
+		}
+
+		notify := t.notify
+
+		t.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return fmt.Errorf("Timed out waiting on transfer %s", t.Key())
+		}
+
+	}
+
+}
+
+type TransferManager struct {
+	Store TransferSessionStore
+	//MaxFrameVersion caps the frame version agreed during negotiation, it defaults to FRAME_VERSION_2
+	MaxFrameVersion uint8
+	//DispatchQueueSize is the number of packets Dispatch queues per session ID, it defaults to DefaultDispatchQueueSize
+	DispatchQueueSize int
+	//OnDispatchError receives the errors from packets processed by Dispatch
+	OnDispatchError func(socketConn *websocket.Conn, id uint64, err error)
+	//Limits are applied to every inbound transfer when it is negotiated
+	Limits TransferLimits
+	//EncryptionSecret returns the secret shared with the peer behind a session key, transfers can only be
+	//encrypted when it is set - see deriveTransferKey
+	EncryptionSecret func(seshKey string) ([]byte, error)
+	//AcceptSeshKeyRotation lets the peer move the connection to a new session key with SESSION_KEY_ROTATE,
+	//OnSeshKeyRotated is called when it does
+	AcceptSeshKeyRotation bool
+	OnSeshKeyRotated      func(socketConn *websocket.Conn, oldKey string, newKey string)
+	//SpillThreshold is how much of an inbound transfer is held in memory before the rest goes to a temporary file
+	//in SpillDir (os.TempDir when empty), it defaults to DefaultSpillThreshold and a negative value never spills
+	SpillThreshold int64
+	SpillDir       string
+	//IdleTimeout is how long a transfer may go without a packet before the reaper expires it, it defaults to
+	//DefaultTransferIdleTimeout - see StartReaper
+	IdleTimeout time.Duration
+	//OnHandlerError is called with every error a TransferHandler returns, including those after the last packet
+	OnHandlerError func(t *Transfer, err error)
+	//OnTransferExpired is called for every transfer the reaper expires, after the peer has been told and its
+	//buffers released, so the application can log it or clean up partial files
+	OnTransferExpired func(t *Transfer, err error)
+	limitsMu          sync.Mutex
+	handlersMu        sync.RWMutex
+	handlers          map[string]TransferHandler
+	dispatchMu        sync.Mutex
+	dispatch          map[dispatchKey]*dispatchQueue
+	reaperMu          sync.Mutex
+	reaper            *transferReaper
+	//transferIDs counts the transfers started from this side, see nextTransferID
+	transferIDs atomic.Uint64
+}
+
+func NewTransferManager() *TransferManager {
+
+	return NewTransferManagerWithStore(NewMemoryTransferSessionStore(DefaultTransferSessionExpiry))
+
+}
+
+// NewTransferManagerWithStore creates a manager on store, a store that expires transfers itself has them expired
+// through the manager, so it should not be shared with another one
+func NewTransferManagerWithStore(store TransferSessionStore) *TransferManager {
+
+	tm := &TransferManager{
+		Store:    store,
+		handlers: map[string]TransferHandler{},
+		dispatch: map[dispatchKey]*dispatchQueue{},
+	}
+
+	if expiring, ok := store.(ExpiringTransferSessionStore); ok {
+		expiring.SetExpireFunc(tm.expireStored)
+	}
+
+	return tm
+
+}
+
+var DefaultTransferManager = NewTransferManager()
+
+func (tm *TransferManager) Transfer(seshKey string, id uint64) *Transfer {
+
+	t, _ := tm.Store.Get(TransferKey(seshKey, id))
+	return t
+
+}
+
+// DetachConn parks every transfer running over a connection that has gone away, they carry on if the peer
+// reconnects with the same session key and sends TRANSFER_RESUME before they expire. What the package held for the
+// connection is released with ReleaseConn.
+func (tm *TransferManager) DetachConn(socketConn *websocket.Conn) {
+
+	tm.Store.Range(func(t *Transfer) bool {
+		t.detach(socketConn)
+		return true
+	})
+
+	ReleaseConn(socketConn)
+
+}
+
+func (tm *TransferManager) putTransfer(t *Transfer) {
+
+	tm.Store.Put(t)
+
+}
+
+func (tm *TransferManager) removeTransfer(t *Transfer) {
+
+	if current, ok := tm.Store.Get(t.Key()); ok && current == t {
+		tm.Store.Delete(t.Key())
+	}
+
+}
@@ -0,0 +1,443 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+// TransferAssembler puts the data packets of a transfer back in order and writes them to a sink, packets that arrive
+// ahead of a gap are held until the gap is filled. Data packets start at seqID 1 - seqID 0 is TRANSFER_BEGIN.
+type TransferAssembler struct {
+	mu       sync.Mutex
+	sink     io.Writer
+	next     uint64
+	pending  map[uint64][]byte
+	final    uint64
+	finished bool
+	closed   bool
+	err      error
+	done     chan struct{}
+	onClose  func(err error)
+	digest   hash.Hash
+	expected []byte
+	limit    int64
+	size     int64
+	expect   int64
+	held     int64
+	maxHeld  int64
+}
+
+func NewTransferAssembler(sink io.Writer) *TransferAssembler {
+
+	return &TransferAssembler{
+		sink:    sink,
+		next:    1,
+		pending: map[uint64][]byte{},
+		done:    make(chan struct{}),
+	}
+
+}
+
+// NewTransferAssemblerReader assembles into a buffer that is drained through the returned reader, the reader
+// returns io.EOF once the transfer has completed or the error the transfer was aborted with
+func NewTransferAssemblerReader() (*TransferAssembler, io.ReadCloser) {
+
+	return NewTransferAssemblerSpillReader(0, "")
+
+}
+
+// NewTransferAssemblerSpillReader is NewTransferAssemblerReader with data beyond threshold bytes that the reader
+// has not caught up with kept in a temporary file in dir (os.TempDir when empty). The file is removed once the
+// reader has drained it, when the reader is closed or when the transfer is aborted.
+func NewTransferAssemblerSpillReader(threshold int64, dir string) (*TransferAssembler, io.ReadCloser) {
+
+	buf := newTransferBuffer(threshold, dir)
+
+	ta := NewTransferAssembler(buf)
+	ta.onClose = buf.CloseWithError
+
+	return ta, buf
+
+}
+
+// EnableDigest hashes everything written to the sink so it can be checked against the digest sent with TRANSFER_COMPLETE
+func (ta *TransferAssembler) EnableDigest(algorithm string) error {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if algorithm != DigestSHA256 {
+		return fmt.Errorf("Unsupported transfer digest %s", algorithm)
+	} else if ta.next != 1 {
+		return errors.New("Digest must be enabled before any data is written")
+	}
+
+	ta.digest = sha256.New()
+
+	return nil
+
+}
+
+// SetLimit caps the bytes the assembler will take, counting both what has been written and what is held waiting on a gap
+func (ta *TransferAssembler) SetLimit(limit int64) {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.limit = limit
+
+}
+
+// SetPendingLimit caps the bytes held in memory waiting on a gap, a peer that never fills the gap is refused
+// instead of growing them without bound
+func (ta *TransferAssembler) SetPendingLimit(limit int64) {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.maxHeld = limit
+
+}
+
+// ExpectSize makes the transfer fail at its terminator unless exactly size bytes have been written, a transfer
+// negotiated with a size must not end short of it
+func (ta *TransferAssembler) ExpectSize(size int64) {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.expect = size
+
+}
+
+// Push hands a data packet to the assembler, packets that have already been written are ignored
+func (ta *TransferAssembler) Push(seq uint64, payload []byte) error {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if ta.closed {
+		if ta.err != nil {
+			return ta.err
+		}
+		return errors.New("Transfer has already been assembled")
+	} else if seq == 0 {
+		return errors.New("Sequence 0 is reserved for TRANSFER_BEGIN")
+	} else if ta.finished && seq >= ta.final {
+		return fmt.Errorf("Sequence %d is beyond the end of the transfer", seq)
+	} else if seq < ta.next {
+		return nil
+	} else if _, ok := ta.pending[seq]; ok {
+		return nil
+	}
+
+	if ta.limit > 0 && ta.size+int64(len(payload)) > ta.limit {
+		return fmt.Errorf("%w: transfer is larger than %d bytes", ErrLimitExceeded, ta.limit)
+	}
+
+	if seq != ta.next && ta.maxHeld > 0 && ta.held+int64(len(payload)) > ta.maxHeld {
+		return fmt.Errorf("%w: more than %d bytes are waiting on packet %d", ErrLimitExceeded, ta.maxHeld, ta.next)
+	}
+
+	ta.size += int64(len(payload))
+
+	if seq != ta.next {
+		ta.pending[seq] = append([]byte(nil), payload...)
+		ta.held += int64(len(payload))
+		return nil
+	}
+
+	if err := ta.write(payload); err != nil {
+		return err
+	}
+
+	for {
+		data, ok := ta.pending[ta.next]
+		if !ok {
+			break
+		}
+		delete(ta.pending, ta.next)
+		ta.held -= int64(len(data))
+		if err := ta.write(data); err != nil {
+			return err
+		}
+	}
+
+	ta.checkComplete()
+
+	return nil
+
+}
+
+// Finish records the TRANSFER_COMPLETE terminator, its seqID is one past the last data packet
+func (ta *TransferAssembler) Finish(seq uint64) error {
+
+	return ta.FinishWithDigest(seq, nil)
+
+}
+
+// FinishWithDigest records a TRANSFER_COMPLETE that carries the digest of the whole transfer, the digest is
+// checked once every packet has been written
+func (ta *TransferAssembler) FinishWithDigest(seq uint64, digest []byte) error {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if ta.closed {
+		return ta.err
+	} else if seq < ta.next {
+		return fmt.Errorf("Transfer terminated at %d but %d packets have already been written", seq, ta.next-1)
+	} else if ta.digest != nil && digest == nil {
+		return errors.New("Transfer completed without the digest it negotiated")
+	} else if ta.digest == nil && digest != nil {
+		return errors.New("Transfer completed with a digest it did not negotiate")
+	}
+
+	ta.finished = true
+	ta.final = seq
+	ta.expected = append([]byte(nil), digest...)
+
+	for pendingSeq := range ta.pending {
+		if pendingSeq >= seq {
+			return fmt.Errorf("Sequence %d is beyond the end of the transfer", pendingSeq)
+		}
+	}
+
+	ta.checkComplete()
+
+	return nil
+
+}
+
+func (ta *TransferAssembler) Abort(err error) {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	if err == nil {
+		err = errors.New("Transfer aborted")
+	}
+
+	ta.close(err)
+
+}
+
+func (ta *TransferAssembler) write(payload []byte) error {
+
+	if _, err := ta.sink.Write(payload); err != nil {
+		ta.close(err)
+		return err
+	}
+
+	if ta.digest != nil {
+		ta.digest.Write(payload)
+	}
+
+	ta.next++
+
+	return nil
+
+}
+
+func (ta *TransferAssembler) checkComplete() {
+
+	if !ta.finished || ta.next != ta.final {
+		return
+	}
+
+	if ta.expect > 0 && ta.size != ta.expect {
+		ta.close(fmt.Errorf("%w: %d of the %d bytes negotiated were sent", ErrTransferIncomplete, ta.size, ta.expect))
+		return
+	}
+
+	if ta.digest != nil {
+		if actual := ta.digest.Sum(nil); !bytes.Equal(actual, ta.expected) {
+			ta.close(&ChecksumError{Algorithm: DigestSHA256, Expected: ta.expected, Actual: actual})
+			return
+		}
+	}
+
+	ta.close(nil)
+
+}
+
+func (ta *TransferAssembler) close(err error) {
+
+	if ta.closed {
+		return
+	}
+
+	ta.closed = true
+	ta.err = err
+	ta.pending = nil
+
+	if ta.onClose != nil {
+		ta.onClose(err)
+	}
+
+	close(ta.done)
+
+}
+
+// Next is the seqID the assembler is waiting on, everything before it has been written to the sink
+func (ta *TransferAssembler) Next() uint64 {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.next
+
+}
+
+// Received is how many bytes of data the assembler has taken, whether written yet or held waiting on a gap
+func (ta *TransferAssembler) Received() int64 {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.size
+
+}
+
+// Closed reports whether the assembler has finished, successfully or not
+func (ta *TransferAssembler) Closed() bool {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.closed
+
+}
+
+// Complete reports whether every packet up to the terminator has been written
+func (ta *TransferAssembler) Complete() bool {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.closed && ta.err == nil
+
+}
+
+func (ta *TransferAssembler) Done() <-chan struct{} {
+
+	return ta.done
+
+}
+
+func (ta *TransferAssembler) Err() error {
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.err
+
+}
+
+// transferBuffer is an unbounded pipe, writes never block so the connection's read loop is not held up by a slow
+// consumer. Once more than threshold bytes are waiting the rest goes to a temporary file in dir, a threshold of 0
+// keeps everything in memory.
+type transferBuffer struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       bytes.Buffer
+	spill     spillFile
+	threshold int64
+	err       error
+	closed    bool
+}
+
+func newTransferBuffer(threshold int64, dir string) *transferBuffer {
+
+	tb := &transferBuffer{threshold: threshold, spill: spillFile{dir: dir}}
+	tb.cond = sync.NewCond(&tb.mu)
+	return tb
+
+}
+
+func (tb *transferBuffer) Write(p []byte) (int, error) {
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.closed {
+		return 0, io.ErrClosedPipe
+	} else if tb.err != nil {
+		return 0, tb.err
+	}
+
+	var n int
+	var err error
+
+	//once anything is on disk everything after it has to go there too or it would be read out of order
+	if tb.spill.Len() > 0 || (tb.threshold > 0 && int64(tb.buf.Len()+len(p)) > tb.threshold) {
+		n, err = tb.spill.Write(p)
+	} else {
+		n, err = tb.buf.Write(p)
+	}
+
+	tb.cond.Broadcast()
+
+	return n, err
+
+}
+
+func (tb *transferBuffer) Read(p []byte) (int, error) {
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	for tb.buf.Len() == 0 && tb.spill.Len() == 0 && tb.err == nil && !tb.closed {
+		tb.cond.Wait()
+	}
+
+	if tb.closed {
+		return 0, io.ErrClosedPipe
+	} else if tb.buf.Len() > 0 {
+		return tb.buf.Read(p)
+	} else if tb.spill.Len() > 0 {
+		return tb.spill.Read(p)
+	}
+
+	//the transfer has ended and everything has been read
+	tb.spill.remove()
+
+	return 0, tb.err
+
+}
+
+// CloseWithError ends the write side, a nil error is reported to the reader as io.EOF. Anything not yet read is
+// thrown away when the transfer has failed, the reader gets the error straight away.
+func (tb *transferBuffer) CloseWithError(err error) {
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	if tb.err == nil {
+		tb.err = err
+	}
+
+	if tb.err != io.EOF {
+		tb.buf.Reset()
+		tb.spill.remove()
+	}
+
+	tb.cond.Broadcast()
+
+}
+
+// Close is called by the reader when it no longer wants the data
+func (tb *transferBuffer) Close() error {
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.closed = true
+	tb.buf.Reset()
+	tb.spill.remove()
+	tb.cond.Broadcast()
+
+	return nil
+
+}
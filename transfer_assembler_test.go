@@ -0,0 +1,270 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// assemblerStep pushes a packet, or records the terminator at seq when finish is set
+type assemblerStep struct {
+	seq    uint64
+	data   string
+	finish bool
+}
+
+func TestAssemblerOrdering(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		steps []assemblerStep
+	}{
+		{"in order", []assemblerStep{{seq: 1, data: "ab"}, {seq: 2, data: "cd"}, {seq: 3, data: "e"}, {seq: 4, finish: true}}},
+		{"reversed", []assemblerStep{{seq: 3, data: "e"}, {seq: 2, data: "cd"}, {seq: 1, data: "ab"}, {seq: 4, finish: true}}},
+		{"duplicates", []assemblerStep{{seq: 2, data: "cd"}, {seq: 2, data: "cd"}, {seq: 1, data: "ab"}, {seq: 1, data: "ab"}, {seq: 3, data: "e"}, {seq: 4, finish: true}}},
+		{"terminator before the gap is filled", []assemblerStep{{seq: 3, data: "e"}, {seq: 4, finish: true}, {seq: 2, data: "cd"}, {seq: 1, data: "ab"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var sink bytes.Buffer
+
+			ta := NewTransferAssembler(&sink)
+
+			for i, step := range tt.steps {
+
+				if ta.Complete() {
+					t.Fatalf("completed before step %d", i)
+				}
+
+				var err error
+
+				if step.finish {
+					err = ta.Finish(step.seq)
+				} else {
+					err = ta.Push(step.seq, []byte(step.data))
+				}
+
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+
+			}
+
+			if !ta.Complete() || ta.Err() != nil {
+				t.Fatalf("complete %t, err %v", ta.Complete(), ta.Err())
+			} else if sink.String() != "abcde" {
+				t.Fatalf("assembled %q", sink.String())
+			}
+
+		})
+	}
+
+}
+
+func TestAssemblerErrors(t *testing.T) {
+
+	digest := sha256.Sum256([]byte("abc"))
+
+	tests := []struct {
+		name string
+		run  func(ta *TransferAssembler) error
+		//is is the error expected, nil when any error will do
+		is error
+	}{
+		{"sequence 0", func(ta *TransferAssembler) error {
+			return ta.Push(0, []byte("a"))
+		}, nil},
+		{"over the size limit", func(ta *TransferAssembler) error {
+			ta.SetLimit(4)
+			ta.Push(1, []byte("abc"))
+			return ta.Push(2, []byte("de"))
+		}, ErrLimitExceeded},
+		{"over the pending limit", func(ta *TransferAssembler) error {
+			ta.SetPendingLimit(4)
+			ta.Push(3, []byte("abc"))
+			return ta.Push(2, []byte("de"))
+		}, ErrLimitExceeded},
+		{"short of the expected size", func(ta *TransferAssembler) error {
+			ta.ExpectSize(10)
+			ta.Push(1, []byte("abc"))
+			ta.Finish(2)
+			return ta.Err()
+		}, ErrTransferIncomplete},
+		{"packet beyond the terminator", func(ta *TransferAssembler) error {
+			ta.Finish(3)
+			return ta.Push(3, []byte("abc"))
+		}, nil},
+		{"terminator before a held packet", func(ta *TransferAssembler) error {
+			ta.Push(5, []byte("abc"))
+			return ta.Finish(3)
+		}, nil},
+		{"terminator before written packets", func(ta *TransferAssembler) error {
+			ta.Push(1, []byte("abc"))
+			ta.Push(2, []byte("abc"))
+			return ta.Finish(2)
+		}, nil},
+		{"digest mismatch", func(ta *TransferAssembler) error {
+			ta.EnableDigest(DigestSHA256)
+			ta.Push(1, []byte("abd"))
+			ta.FinishWithDigest(2, digest[:])
+			var checksumErr *ChecksumError
+			if err := ta.Err(); !errors.As(err, &checksumErr) {
+				return errors.New("not a checksum error")
+			}
+			return ta.Err()
+		}, nil},
+		{"digest missing", func(ta *TransferAssembler) error {
+			ta.EnableDigest(DigestSHA256)
+			ta.Push(1, []byte("abc"))
+			return ta.Finish(2)
+		}, nil},
+		{"digest not negotiated", func(ta *TransferAssembler) error {
+			ta.Push(1, []byte("abc"))
+			return ta.FinishWithDigest(2, digest[:])
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.run(NewTransferAssembler(io.Discard))
+
+			if err == nil {
+				t.Fatal("expected an error")
+			} else if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Fatalf("got %v, expected %v", err, tt.is)
+			}
+
+		})
+	}
+
+}
+
+func TestAssemblerDigest(t *testing.T) {
+
+	digest := sha256.Sum256([]byte("abc"))
+
+	ta := NewTransferAssembler(io.Discard)
+
+	if err := ta.EnableDigest(DigestSHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	ta.Push(2, []byte("c"))
+	ta.Push(1, []byte("ab"))
+
+	if err := ta.FinishWithDigest(3, digest[:]); err != nil {
+		t.Fatal(err)
+	} else if !ta.Complete() || ta.Err() != nil {
+		t.Fatalf("complete %t, err %v", ta.Complete(), ta.Err())
+	}
+
+}
+
+func TestAssemblerReader(t *testing.T) {
+
+	ta, reader := NewTransferAssemblerReader()
+
+	ta.Push(2, []byte("world"))
+	ta.Push(1, []byte("hello "))
+	ta.Finish(3)
+
+	if data, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello world" {
+		t.Fatalf("read %q", data)
+	}
+
+	//an aborted transfer hands its error to the reader in place of io.EOF
+	aborted := errors.New("aborted")
+
+	ta, reader = NewTransferAssemblerReader()
+
+	ta.Push(1, []byte("hello"))
+	ta.Abort(aborted)
+
+	if _, err := io.ReadAll(reader); !errors.Is(err, aborted) {
+		t.Fatalf("got %v", err)
+	}
+
+}
+
+func TestSpillFile(t *testing.T) {
+
+	sf := spillFile{dir: t.TempDir()}
+	defer sf.remove()
+
+	sf.Write([]byte("hello "))
+	sf.Write([]byte("world"))
+
+	if sf.Len() != 11 {
+		t.Fatalf("%d bytes on disk", sf.Len())
+	}
+
+	buf := make([]byte, 6)
+
+	if n, err := sf.Read(buf); err != nil || string(buf[:n]) != "hello " {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	} else if n, err := sf.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	//a drained file is cut back to nothing and written again from the front
+
+	if info, err := sf.file.Stat(); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 || sf.Len() != 0 {
+		t.Fatalf("drained file is %d bytes", info.Size())
+	}
+
+	sf.Write([]byte("again"))
+
+	if n, err := sf.Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	} else if _, err := sf.Read(buf); err != io.EOF {
+		t.Fatalf("read past the end got %v", err)
+	}
+
+	name := sf.file.Name()
+
+	sf.remove()
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("spill file was not removed: %v", err)
+	}
+
+}
+
+func TestAssemblerSpill(t *testing.T) {
+
+	dir := t.TempDir()
+
+	ta, reader := NewTransferAssemblerSpillReader(4, dir)
+
+	//the first packet fits in memory, the second goes over the threshold and everything after it follows it to disk
+	ta.Push(1, []byte("ab"))
+	ta.Push(2, []byte("cdef"))
+	ta.Push(3, []byte("g"))
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d spill files", len(entries))
+	}
+
+	ta.Finish(4)
+
+	if data, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "abcdefg" {
+		t.Fatalf("read %q", data)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%d spill files left after the transfer was read", len(entries))
+	}
+
+}
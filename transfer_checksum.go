@@ -0,0 +1,147 @@
+package go_wsutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"hash/crc32"
+)
+
+const (
+	ChecksumCRC32C = "crc32c"
+	DigestSHA256   = "sha256"
+)
+
+// FRAME_FLAG_CRC32C marks a version 2 frame whose payload ends with the little endian CRC32C of the bytes before it
+var FRAME_FLAG_CRC32C = (uint8)(0x01)
+var CRC32C_SIZE_BYTES = 4
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+// ChecksumError is reported to the peer as TRANSFER_ERROR and becomes the error of the transfer and its reader,
+// Seq is 0 when it is the digest of the whole transfer that does not match
+type ChecksumError struct {
+	Algorithm string
+	Seq       uint64
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *ChecksumError) Error() string {
+
+	if e.Seq == 0 {
+		return fmt.Sprintf("%s digest mismatch for transfer, expected %x got %x", e.Algorithm, e.Expected, e.Actual)
+	}
+
+	return fmt.Sprintf("%s checksum mismatch for packet %d, expected %x got %x", e.Algorithm, e.Seq, e.Expected, e.Actual)
+
+}
+
+func (e *ChecksumError) Is(target error) bool {
+
+	return target == ErrChecksumMismatch
+
+}
+
+func appendCRC32C(payload []byte) []byte {
+
+	return binary.LittleEndian.AppendUint32(payload, crc32.Checksum(payload, crc32cTable))
+
+}
+
+// verifyCRC32C checks and strips the checksum from the end of a payload
+func verifyCRC32C(seq uint64, payload []byte) ([]byte, error) {
+
+	if len(payload) < CRC32C_SIZE_BYTES {
+		return nil, fmt.Errorf("Packet %d is too small to carry a %s checksum", seq, ChecksumCRC32C)
+	}
+
+	data := payload[:len(payload)-CRC32C_SIZE_BYTES]
+	expected := payload[len(payload)-CRC32C_SIZE_BYTES:]
+
+	actual := binary.LittleEndian.AppendUint32(nil, crc32.Checksum(data, crc32cTable))
+
+	if string(actual) != string(expected) {
+		return nil, &ChecksumError{Algorithm: ChecksumCRC32C, Seq: seq, Expected: append([]byte(nil), expected...), Actual: actual}
+	}
+
+	return data, nil
+
+}
+
+// openChunk verifies and strips whatever the sender wrapped a data packet in, undoing sealChunk in reverse
+func (t *Transfer) openChunk(header FrameHeader, payload []byte) ([]byte, error) {
+
+	negotiation := t.Negotiation()
+
+	if header.Flags&FRAME_FLAG_CRC32C != 0 {
+
+		data, err := verifyCRC32C(header.SeqID, payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		payload = data
+
+	} else if negotiation.ChunkChecksum != "" {
+		return nil, fmt.Errorf("Packet %d is missing its %s checksum", header.SeqID, negotiation.ChunkChecksum)
+	}
+
+	if header.Flags&FRAME_FLAG_ENCRYPTED != 0 {
+
+		data, err := t.decryptChunk(header, payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		payload = data
+
+	} else if negotiation.Encryption != "" {
+		return nil, fmt.Errorf("Packet %d was not encrypted with %s", header.SeqID, negotiation.Encryption)
+	}
+
+	if header.Flags&FRAME_FLAG_COMPRESSED != 0 {
+		return decompressChunk(negotiation.Compression, header.SeqID, payload)
+	}
+
+	return payload, nil
+
+}
+
+// sealChunk wraps a data packet in whatever was negotiated, returning the payload to send and its frame flags -
+// the data is compressed first, then encrypted, and the checksum covers the bytes that actually go over the wire
+func (t *Transfer) sealChunk(seq uint64, data []byte) ([]byte, uint8) {
+
+	negotiation := t.Negotiation()
+
+	var flags uint8
+
+	if isCompressionCodec(negotiation.Compression) {
+		if compressed, err := compressChunk(negotiation.Compression, data); err == nil && len(compressed) < len(data) {
+			data = compressed
+			flags |= FRAME_FLAG_COMPRESSED
+		}
+	}
+
+	if negotiation.ChunkChecksum == ChecksumCRC32C {
+		flags |= FRAME_FLAG_CRC32C
+	}
+
+	if negotiation.Encryption != "" {
+		//every flag has to be set before sealing, they are authenticated along with the data
+		flags |= FRAME_FLAG_ENCRYPTED
+		data = t.encryptChunk(NewFrameHeaderV2(t.ID, seq, uuid.Nil, TRANSFER_CHUNK, flags, 0), data)
+	}
+
+	if flags&FRAME_FLAG_CRC32C != 0 {
+		data = appendCRC32C(append(make([]byte, 0, len(data)+CRC32C_SIZE_BYTES), data...))
+	}
+
+	return data, flags
+
+}
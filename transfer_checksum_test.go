@@ -0,0 +1,117 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// sealedTransfer is a transfer that has agreed negotiation, with its cipher in place when encryption was agreed
+func sealedTransfer(tb testing.TB, negotiation TransferNegotiation) *Transfer {
+
+	t := NewTransfer(1, seshKeyString(testSeshKey), TransferOutbound)
+	t.setNegotiation(negotiation)
+
+	if negotiation.Encryption == "" {
+		return t
+	}
+
+	tm := NewTransferManager()
+	tm.EncryptionSecret = func(seshKey string) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+
+	aead, err := tm.transferCipher(t.SeshKey, t.ID, negotiation)
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	t.setCipher(aead)
+
+	return t
+
+}
+
+// sealFrame seals data as packet seq and returns the header it would be sent with
+func sealFrame(t *Transfer, seq uint64, data []byte) (FrameHeader, []byte) {
+
+	payload, flags := t.sealChunk(seq, data)
+
+	return NewFrameHeaderV2(t.ID, seq, testSeshKey, TRANSFER_CHUNK, flags, len(payload)), payload
+
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+
+	salt := bytes.Repeat([]byte{1}, ENCRYPTION_SALT_SIZE_BYTES)
+
+	tests := []struct {
+		name        string
+		negotiation TransferNegotiation
+		flags       uint8
+	}{
+		{"plain", TransferNegotiation{FrameVersion: FRAME_VERSION_2}, 0},
+		{"crc32c", TransferNegotiation{FrameVersion: FRAME_VERSION_2, ChunkChecksum: ChecksumCRC32C}, FRAME_FLAG_CRC32C},
+		{"gzip", TransferNegotiation{FrameVersion: FRAME_VERSION_2, Compression: CompressionGzip}, FRAME_FLAG_COMPRESSED},
+		{"deflate", TransferNegotiation{FrameVersion: FRAME_VERSION_2, Compression: CompressionDeflate}, FRAME_FLAG_COMPRESSED},
+		{"aes-256-gcm", TransferNegotiation{FrameVersion: FRAME_VERSION_2, Encryption: EncryptionAES256GCM, Salt: salt}, FRAME_FLAG_ENCRYPTED},
+		{"everything", TransferNegotiation{FrameVersion: FRAME_VERSION_2, ChunkChecksum: ChecksumCRC32C, Compression: CompressionGzip, Encryption: EncryptionAES256GCM, Salt: salt}, FRAME_FLAG_CRC32C | FRAME_FLAG_COMPRESSED | FRAME_FLAG_ENCRYPTED},
+	}
+
+	data := bytes.Repeat([]byte("go_wsutils "), 100)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tr := sealedTransfer(t, tt.negotiation)
+
+			header, payload := sealFrame(tr, 1, data)
+
+			if header.Flags != tt.flags {
+				t.Fatalf("flags %#x, expected %#x", header.Flags, tt.flags)
+			}
+
+			if opened, err := tr.openChunk(header, payload); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(opened, data) {
+				t.Fatal("opened data does not match")
+			}
+
+		})
+	}
+
+}
+
+func TestChunkChecksumTamper(t *testing.T) {
+
+	tr := sealedTransfer(t, TransferNegotiation{FrameVersion: FRAME_VERSION_2, ChunkChecksum: ChecksumCRC32C})
+
+	header, payload := sealFrame(tr, 3, []byte("hello world"))
+
+	for i := range payload {
+
+		tampered := append([]byte(nil), payload...)
+		tampered[i] ^= 0x01
+
+		_, err := tr.openChunk(header, tampered)
+
+		var checksumErr *ChecksumError
+
+		if !errors.As(err, &checksumErr) || !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("flipping byte %d got %v", i, err)
+		} else if checksumErr.Seq != 3 {
+			t.Fatalf("checksum error for packet %d", checksumErr.Seq)
+		}
+
+	}
+
+	//a packet that lost its flag is refused rather than passed on with the checksum still attached
+
+	header.Flags = 0
+
+	if _, err := tr.openChunk(header, payload); err == nil {
+		t.Fatal("a packet without its checksum was accepted")
+	}
+
+}
@@ -0,0 +1,122 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	CompressionNone    = "none"
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+)
+
+// FRAME_FLAG_COMPRESSED marks a version 2 frame whose payload was compressed with the negotiated codec, chunks that
+// do not get any smaller are sent as they are without the flag
+var FRAME_FLAG_COMPRESSED = (uint8)(0x02)
+
+// MaxDecompressedChunkSize stops a small compressed packet from expanding into an unbounded amount of memory
+var MaxDecompressedChunkSize = 16 * 1024 * 1024
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func isCompressionCodec(codec string) bool {
+
+	return codec == CompressionGzip || codec == CompressionDeflate
+
+}
+
+// compressChunk compresses each packet on its own so the receiver can decompress packets as they arrive, in any order
+func compressChunk(codec string, data []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	switch codec {
+
+	case CompressionDeflate:
+
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+
+		w.Reset(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		} else if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+	case CompressionGzip:
+
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+
+		w.Reset(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		} else if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("Unsupported compression %s", codec)
+
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+func decompressChunk(codec string, seq uint64, payload []byte) ([]byte, error) {
+
+	var r io.ReadCloser
+
+	switch codec {
+
+	case CompressionDeflate:
+		r = flate.NewReader(bytes.NewReader(payload))
+
+	case CompressionGzip:
+
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress packet %d: %s", seq, err.Error())
+		}
+
+		r = gz
+
+	default:
+		return nil, fmt.Errorf("Packet %d is compressed but no compression was negotiated", seq)
+
+	}
+
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(MaxDecompressedChunkSize)+1))
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress packet %d: %s", seq, err.Error())
+	} else if len(data) > MaxDecompressedChunkSize {
+		return nil, fmt.Errorf("%w: packet %d decompresses to more than %d bytes", ErrLimitExceeded, seq, MaxDecompressedChunkSize)
+	}
+
+	return data, nil
+
+}
@@ -0,0 +1,68 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecompressionLimit(t *testing.T) {
+
+	defer func(limit int) {
+		MaxDecompressedChunkSize = limit
+	}(MaxDecompressedChunkSize)
+
+	MaxDecompressedChunkSize = 64 * 1024
+
+	tests := []struct {
+		codec string
+		size  int
+		is    error
+	}{
+		{CompressionGzip, 64 * 1024, nil},
+		{CompressionGzip, 64*1024 + 1, ErrLimitExceeded},
+		{CompressionGzip, 1024 * 1024, ErrLimitExceeded},
+		{CompressionDeflate, 64 * 1024, nil},
+		{CompressionDeflate, 64*1024 + 1, ErrLimitExceeded},
+		{CompressionDeflate, 1024 * 1024, ErrLimitExceeded},
+	}
+
+	for _, tt := range tests {
+
+		tr := sealedTransfer(t, TransferNegotiation{FrameVersion: FRAME_VERSION_2, Compression: tt.codec})
+
+		//a run of zeros packs a large packet into a few hundred bytes
+		compressed, err := compressChunk(tt.codec, make([]byte, tt.size))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := NewFrameHeaderV2(tr.ID, 1, testSeshKey, TRANSFER_CHUNK, FRAME_FLAG_COMPRESSED, len(compressed))
+
+		data, err := tr.openChunk(header, compressed)
+
+		if tt.is == nil && (err != nil || len(data) != tt.size) {
+			t.Fatalf("%s of %d bytes got %d bytes, %v", tt.codec, tt.size, len(data), err)
+		} else if tt.is != nil && !errors.Is(err, tt.is) {
+			t.Fatalf("%s of %d bytes got %v, expected %v", tt.codec, tt.size, err, tt.is)
+		}
+
+	}
+
+}
+
+func TestCompressionSkipsIncompressible(t *testing.T) {
+
+	tr := sealedTransfer(t, TransferNegotiation{FrameVersion: FRAME_VERSION_2, Compression: CompressionGzip})
+
+	//gzip adds its header and trailer to data it can not shrink, the packet goes out as it is instead
+	data := []byte("abc")
+
+	header, payload := sealFrame(tr, 1, data)
+
+	if header.Flags&FRAME_FLAG_COMPRESSED != 0 || !bytes.Equal(payload, data) {
+		t.Fatalf("flags %#x, payload %q", header.Flags, payload)
+	}
+
+}
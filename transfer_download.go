@@ -0,0 +1,45 @@
+package go_wsutils
+
+import (
+	"github.com/768bit/websocket"
+	"io"
+)
+
+// DownloadPurpose is the purpose downloads offered with ServeDownload are negotiated under, the client registers
+// its TransferHandler for it
+var DownloadPurpose = "download"
+
+// SERVER_TRANSFER_ID_FLAG is set on the ID of every transfer the server starts so they can never collide with the
+// IDs a client picks for its own uploads under the same session key
+var SERVER_TRANSFER_ID_FLAG = uint64(1) << 63
+
+// nextTransferID hands out the IDs for transfers started from this side
+func (tm *TransferManager) nextTransferID() uint64 {
+
+	return tm.transferIDs.Add(1) | SERVER_TRANSFER_ID_FLAG
+
+}
+
+func ServeDownload(socketConn *websocket.Conn, r io.Reader, meta TransferMetadata) error {
+
+	return DefaultTransferManager.ServeDownload(socketConn, r, meta)
+
+}
+
+// ServeDownload offers r to the client as a download - NEGOTIATE_TRANSFER carries meta and once the client has
+// answered with NEGOTIATE_TRANSFER_ACK the data is streamed to it, the call returns when the client has it all
+func (tm *TransferManager) ServeDownload(socketConn *websocket.Conn, r io.Reader, meta TransferMetadata) error {
+
+	if sized, ok := r.(interface{ Len() int }); ok && meta.Size == 0 {
+		meta.Size = int64(sized.Len())
+	}
+
+	ts := tm.NewTransferSender(socketConn, tm.nextTransferID(), parseSeshKey(CurrentSeshKey(socketConn)))
+
+	ts.Negotiation.Purpose = DownloadPurpose
+	ts.Negotiation.Size = meta.Size
+	ts.Negotiation.Metadata = &meta
+
+	return ts.Send(r)
+
+}
@@ -0,0 +1,178 @@
+package go_wsutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+const EncryptionAES256GCM = "aes-256-gcm"
+
+// FRAME_FLAG_ENCRYPTED marks a version 2 frame whose payload is sealed with the AEAD agreed for the transfer, once
+// encryption has been agreed every data packet must carry it
+var FRAME_FLAG_ENCRYPTED = (uint8)(0x04)
+
+var ENCRYPTION_SALT_SIZE_BYTES = 16
+
+// the nonce is the seshID followed by the seqID of the packet, both are unique to a packet within a transfer
+var ENCRYPTION_NONCE_SIZE_BYTES = 16
+
+var ENCRYPTION_TAG_SIZE_BYTES = 16
+
+var ErrEncryptionUnavailable = errors.New("Transfer encryption is not available")
+var ErrDecryptionFailed = errors.New("Unable to decrypt packet")
+
+// the session key travels in the clear in every header so it can not be the key on its own, the application
+// supplies a secret only the two ends share (from its login or ticket exchange) through TransferManager.EncryptionSecret
+var transferKeyLabel = []byte("go_wsutils transfer key")
+
+// deriveTransferKey gives every transfer its own key - HMAC-SHA256 of the session key, the transfer ID and the
+// salt sent with NEGOTIATE_TRANSFER under the shared secret
+func deriveTransferKey(secret []byte, seshKey string, id uint64, salt []byte) []byte {
+
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write(transferKeyLabel)
+	mac.Write([]byte(seshKey))
+	mac.Write(binary.LittleEndian.AppendUint64(nil, id))
+	mac.Write(salt)
+
+	return mac.Sum(nil)
+
+}
+
+func newEncryptionSalt() ([]byte, error) {
+
+	salt := make([]byte, ENCRYPTION_SALT_SIZE_BYTES)
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+
+}
+
+// transferCipher builds the AEAD for a transfer that has agreed to encryption
+func (tm *TransferManager) transferCipher(seshKey string, id uint64, negotiation TransferNegotiation) (cipher.AEAD, error) {
+
+	if negotiation.Encryption != EncryptionAES256GCM {
+		return nil, fmt.Errorf("%w: unsupported encryption %q", ErrEncryptionUnavailable, negotiation.Encryption)
+	} else if negotiation.FrameVersion < FRAME_VERSION_2 {
+		return nil, fmt.Errorf("%w: encryption needs version 2 frames", ErrEncryptionUnavailable)
+	} else if len(negotiation.Salt) < ENCRYPTION_SALT_SIZE_BYTES {
+		return nil, fmt.Errorf("%w: salt must be at least %d bytes", ErrEncryptionUnavailable, ENCRYPTION_SALT_SIZE_BYTES)
+	} else if tm.EncryptionSecret == nil {
+		return nil, fmt.Errorf("%w: no encryption secret has been configured", ErrEncryptionUnavailable)
+	}
+
+	secret, err := tm.EncryptionSecret(seshKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEncryptionUnavailable, err.Error())
+	} else if len(secret) == 0 {
+		return nil, fmt.Errorf("%w: no encryption secret for the session", ErrEncryptionUnavailable)
+	}
+
+	block, err := aes.NewCipher(deriveTransferKey(secret, seshKey, id, negotiation.Salt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCMWithNonceSize(block, ENCRYPTION_NONCE_SIZE_BYTES)
+
+}
+
+func chunkNonce(id uint64, seq uint64) []byte {
+
+	nonce := make([]byte, 0, ENCRYPTION_NONCE_SIZE_BYTES)
+	nonce = binary.LittleEndian.AppendUint64(nonce, id)
+
+	return binary.LittleEndian.AppendUint64(nonce, seq)
+
+}
+
+func (t *Transfer) setCipher(aead cipher.AEAD) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.aead = aead
+
+}
+
+func (t *Transfer) transferCipher() cipher.AEAD {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.aead
+
+}
+
+// headerAAD is the part of the frame header the AEAD authenticates along with the payload, so a sealed payload can
+// not be moved to another transfer, sequence or command and its flags can not be changed in transit. The length is
+// left out as the AEAD covers the payload itself.
+func headerAAD(h FrameHeader) []byte {
+
+	aad := make([]byte, 0, 20)
+	aad = binary.LittleEndian.AppendUint64(aad, h.SeshID)
+	aad = binary.LittleEndian.AppendUint64(aad, h.SeqID)
+	aad = binary.LittleEndian.AppendUint16(aad, h.Cmd)
+
+	return append(aad, h.Version, h.Flags)
+
+}
+
+// encryptChunk seals the payload of the packet described by h, h must carry the flags the packet is sent with
+func (t *Transfer) encryptChunk(h FrameHeader, data []byte) []byte {
+
+	return t.transferCipher().Seal(nil, chunkNonce(t.ID, h.SeqID), data, headerAAD(h))
+
+}
+
+func (t *Transfer) decryptChunk(h FrameHeader, payload []byte) ([]byte, error) {
+
+	aead := t.transferCipher()
+
+	if aead == nil {
+		return nil, fmt.Errorf("%w %d: no encryption was agreed", ErrDecryptionFailed, h.SeqID)
+	}
+
+	data, err := aead.Open(nil, chunkNonce(t.ID, h.SeqID), payload, headerAAD(h))
+
+	if err != nil {
+		return nil, fmt.Errorf("%w %d: %s", ErrDecryptionFailed, h.SeqID, err.Error())
+	}
+
+	return data, nil
+
+}
+
+// sealDigest encrypts the digest sent with TRANSFER_COMPLETE at seq, it is a hash of the plaintext and would
+// otherwise give away which file was sent. seq is one past the last data packet so its nonce is never reused.
+func (t *Transfer) sealDigest(seq uint64, digest []byte) []byte {
+
+	if t.transferCipher() == nil {
+		return digest
+	}
+
+	return t.encryptChunk(NewFrameHeader(t.ID, seq, uuid.Nil, TRANSFER_COMPLETE, 0), digest)
+
+}
+
+// openDigest undoes sealDigest for the TRANSFER_COMPLETE described by h
+func (t *Transfer) openDigest(h FrameHeader, payload []byte) ([]byte, error) {
+
+	if t.transferCipher() == nil {
+		return payload, nil
+	}
+
+	return t.decryptChunk(h, payload)
+
+}
@@ -0,0 +1,87 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChunkEncryptionTamper(t *testing.T) {
+
+	negotiation := TransferNegotiation{FrameVersion: FRAME_VERSION_2, Encryption: EncryptionAES256GCM, Salt: bytes.Repeat([]byte{1}, ENCRYPTION_SALT_SIZE_BYTES)}
+
+	tests := []struct {
+		name   string
+		tamper func(header *FrameHeader, payload []byte)
+	}{
+		{"payload", func(header *FrameHeader, payload []byte) {
+			payload[0] ^= 0x01
+		}},
+		{"tag", func(header *FrameHeader, payload []byte) {
+			payload[len(payload)-1] ^= 0x01
+		}},
+		{"flags", func(header *FrameHeader, payload []byte) {
+			header.Flags |= FRAME_FLAG_COMPRESSED
+		}},
+		{"seq", func(header *FrameHeader, payload []byte) {
+			header.SeqID++
+		}},
+		{"transfer", func(header *FrameHeader, payload []byte) {
+			header.SeshID++
+		}},
+		{"cmd", func(header *FrameHeader, payload []byte) {
+			header.Cmd = TRANSFER_COMPLETE
+		}},
+	}
+
+	data := []byte("hello world")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tr := sealedTransfer(t, negotiation)
+
+			header, payload := sealFrame(tr, 2, data)
+
+			if opened, err := tr.openChunk(header, payload); err != nil || !bytes.Equal(opened, data) {
+				t.Fatalf("untouched packet got %q, %v", opened, err)
+			}
+
+			tt.tamper(&header, payload)
+
+			if _, err := tr.openChunk(header, payload); !errors.Is(err, ErrDecryptionFailed) {
+				t.Fatalf("got %v", err)
+			}
+
+		})
+	}
+
+}
+
+func TestDigestEncryption(t *testing.T) {
+
+	tr := sealedTransfer(t, TransferNegotiation{FrameVersion: FRAME_VERSION_2, Encryption: EncryptionAES256GCM, Salt: bytes.Repeat([]byte{1}, ENCRYPTION_SALT_SIZE_BYTES)})
+
+	digest := bytes.Repeat([]byte{0xAB}, 32)
+
+	sealed := tr.sealDigest(5, digest)
+
+	if bytes.Contains(sealed, digest) {
+		t.Fatal("the digest was sent in the clear")
+	}
+
+	header := NewFrameHeader(tr.ID, 5, testSeshKey, TRANSFER_COMPLETE, len(sealed))
+
+	if opened, err := tr.openDigest(header, sealed); err != nil || !bytes.Equal(opened, digest) {
+		t.Fatalf("got %x, %v", opened, err)
+	}
+
+	//the digest is tied to the terminator it was sent with
+
+	header.SeqID++
+
+	if _, err := tr.openDigest(header, sealed); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("got %v", err)
+	}
+
+}
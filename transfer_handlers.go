@@ -0,0 +1,273 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TransferHandler receives the data of an inbound transfer, ServeTransfer runs in its own goroutine from
+// TRANSFER_BEGIN and r returns io.EOF only once the whole transfer has arrived intact
+type TransferHandler interface {
+	ServeTransfer(t *Transfer, r io.Reader) error
+}
+
+// TransferAcceptor is implemented by handlers that want to look at a transfer before agreeing to it, AcceptTransfer
+// is called when NEGOTIATE_TRANSFER arrives with t.Metadata() already parsed and an error refuses the transfer. It is
+// not called under any lock, so a transfer it accepts can still be refused if the limits filled up in the meantime.
+type TransferAcceptor interface {
+	AcceptTransfer(t *Transfer) error
+}
+
+type TransferHandlerFunc func(t *Transfer, r io.Reader) error
+
+func (f TransferHandlerFunc) ServeTransfer(t *Transfer, r io.Reader) error {
+
+	return f(t, r)
+
+}
+
+// Handle registers the handler for transfers negotiated with purpose, the handler registered for "" takes
+// transfers that do not name a purpose. Transfers with a purpose that has no handler are refused.
+func (tm *TransferManager) Handle(purpose string, handler TransferHandler) {
+
+	tm.handlersMu.Lock()
+	defer tm.handlersMu.Unlock()
+
+	if handler == nil {
+		delete(tm.handlers, purpose)
+	} else {
+		tm.handlers[purpose] = handler
+	}
+
+}
+
+func (tm *TransferManager) HandleFunc(purpose string, fn func(t *Transfer, r io.Reader) error) {
+
+	tm.Handle(purpose, TransferHandlerFunc(fn))
+
+}
+
+func (tm *TransferManager) handler(purpose string) (TransferHandler, bool) {
+
+	tm.handlersMu.RLock()
+	defer tm.handlersMu.RUnlock()
+
+	handler, ok := tm.handlers[purpose]
+
+	return handler, ok
+
+}
+
+// serveTransfer hands the reassembled stream to the handler for the transfer's purpose. A transfer that confirms
+// completion is only acknowledged once the handler has returned, so the sender hears about a handler that fails
+// after the last packet with TRANSFER_ERROR rather than being told the transfer went through.
+func (tm *TransferManager) serveTransfer(t *Transfer) {
+
+	handler, ok := tm.handler(t.Negotiation().Purpose)
+
+	if !ok {
+		tm.rejectTransfer(t.Conn(), t, t.ID, t.Seq(), parseSeshKey(t.SeshKey), streamError(TRANSFER_ERROR, StreamErrorHandler, fmt.Errorf("No transfer handler registered for %q", t.Negotiation().Purpose)))
+		return
+	}
+
+	reader := t.Reader()
+
+	go func() {
+
+		err := handler.ServeTransfer(t, reader)
+
+		//closing the reader makes any further writes fail so a handler that stops reading early aborts the transfer
+		reader.Close()
+
+		if err != nil {
+			tm.handlerFailed(t, err)
+			return
+		}
+
+		//the handler may have seen io.EOF just before the transfer was marked complete
+		if err := t.waitUntil(func() bool { return t.state == TransferComplete }, tm.idleTimeout()); err != nil {
+			return
+		}
+
+		if confirmsCompletion(t.Negotiation()) {
+			SendStreamCmdRequest(t.Conn(), t.ID, t.Seq(), parseSeshKey(t.SeshKey), TRANSFER_SEQ_ACK, FINAL_BYTE_MARKER)
+		}
+
+	}()
+
+}
+
+// handlerFailed reports an error returned by a transfer handler to OnHandlerError and to the peer, unless it is the
+// transfer's own failure coming back out of the reader
+func (tm *TransferManager) handlerFailed(t *Transfer, err error) {
+
+	if t.failedWith(err) {
+		//whatever failed the transfer has already told the peer
+		return
+	}
+
+	if tm.OnHandlerError != nil {
+		tm.OnHandlerError(t, err)
+	}
+
+	streamErr := streamError(TRANSFER_ERROR, StreamErrorHandler, err)
+
+	if t.State() != TransferComplete {
+		tm.rejectTransfer(t.Conn(), t, t.ID, t.Seq(), parseSeshKey(t.SeshKey), streamErr)
+		return
+	}
+
+	//every packet arrived but the data never made it to where the handler was putting it, the sender is still
+	//waiting on the final ack if it confirms completion
+	SendStreamError(t.Conn(), t.ID, t.Seq(), parseSeshKey(t.SeshKey), TRANSFER_ERROR, streamErr)
+
+}
+
+// DiskTransferHandler writes each transfer to a file under Root, the data goes to a temporary file that is only
+// renamed into place once the transfer has completed
+type DiskTransferHandler struct {
+	Root string
+	Perm os.FileMode
+	//FileName picks the name of the file under Root, it defaults to the session key and transfer ID
+	FileName func(t *Transfer) string
+	//OnStored is called with the final path of every completed transfer
+	OnStored func(t *Transfer, path string)
+}
+
+func NewDiskTransferHandler(root string) *DiskTransferHandler {
+
+	return &DiskTransferHandler{
+		Root: root,
+		Perm: 0644,
+	}
+
+}
+
+// Path is where a transfer ends up, names are reduced to their base so they cannot escape Root
+func (dh *DiskTransferHandler) Path(t *Transfer) string {
+
+	name := ""
+
+	if dh.FileName != nil {
+		name = filepath.Base(filepath.Clean(dh.FileName(t)))
+	}
+
+	if name == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		name = fmt.Sprintf("%s-%016x", t.SeshKey, t.ID)
+	}
+
+	return filepath.Join(dh.Root, name)
+
+}
+
+func (dh *DiskTransferHandler) ServeTransfer(t *Transfer, r io.Reader) error {
+
+	if err := os.MkdirAll(dh.Root, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dh.Root, ".transfer-*")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, r)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && dh.Perm != 0 {
+		err = os.Chmod(tmp.Name(), dh.Perm)
+	}
+
+	path := dh.Path(t)
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if dh.OnStored != nil {
+		dh.OnStored(t, path)
+	}
+
+	return nil
+
+}
+
+// MemoryTransferHandler keeps completed transfers in memory until they are taken, MaxBytes (if set) caps the size
+// of a single transfer
+type MemoryTransferHandler struct {
+	MaxBytes int64
+	//OnComplete is called with the data of every completed transfer, when it is set the data is not kept
+	OnComplete func(t *Transfer, data []byte)
+	mu         sync.Mutex
+	completed  map[string][]byte
+}
+
+func NewMemoryTransferHandler(maxBytes int64) *MemoryTransferHandler {
+
+	return &MemoryTransferHandler{
+		MaxBytes:  maxBytes,
+		completed: map[string][]byte{},
+	}
+
+}
+
+func (mh *MemoryTransferHandler) ServeTransfer(t *Transfer, r io.Reader) error {
+
+	var buf bytes.Buffer
+
+	if mh.MaxBytes > 0 {
+
+		n, err := io.Copy(&buf, io.LimitReader(r, mh.MaxBytes+1))
+
+		if err != nil {
+			return err
+		} else if n > mh.MaxBytes {
+			return fmt.Errorf("Transfer is larger than the %d bytes allowed", mh.MaxBytes)
+		}
+
+	} else if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+
+	if mh.OnComplete != nil {
+		mh.OnComplete(t, buf.Bytes())
+		return nil
+	}
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	mh.completed[t.Key()] = buf.Bytes()
+
+	return nil
+
+}
+
+// Take returns and forgets the data of a completed transfer
+func (mh *MemoryTransferHandler) Take(seshKey string, id uint64) ([]byte, bool) {
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	key := TransferKey(seshKey, id)
+
+	data, ok := mh.completed[key]
+
+	delete(mh.completed, key)
+
+	return data, ok
+
+}
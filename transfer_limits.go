@@ -0,0 +1,114 @@
+package go_wsutils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLimitExceeded = errors.New("Transfer limit exceeded")
+var ErrTransferIncomplete = errors.New("Transfer ended short of its negotiated size")
+
+// TransferLimits guard what a peer may push through a TransferManager, a zero field is not limited
+type TransferLimits struct {
+	//MaxBytes caps the size of a single inbound transfer, it is checked against the size offered in
+	//NEGOTIATE_TRANSFER and again as the data arrives
+	MaxBytes int64
+	//MaxConcurrent caps the inbound transfers a session key may have open at once
+	MaxConcurrent int
+	//BytesPerSecond is the fastest a peer may send, the sender is told the rate during negotiation and inbound
+	//data arriving faster than that is held back
+	BytesPerSecond int64
+}
+
+// checkLimits decides whether a NEGOTIATE_TRANSFER can be accepted, the final check must hold tm.limitsMu until the
+// transfer has been stored or the concurrent count could be overrun
+func (tm *TransferManager) checkLimits(seshKey string, requested TransferNegotiation) error {
+
+	limits := tm.Limits
+
+	if limits.MaxBytes > 0 && requested.Size > limits.MaxBytes {
+		return fmt.Errorf("%w: %d bytes offered but at most %d are accepted", ErrLimitExceeded, requested.Size, limits.MaxBytes)
+	}
+
+	if limits.MaxConcurrent > 0 {
+
+		open := 0
+
+		tm.Store.Range(func(t *Transfer) bool {
+			if t.SeshKey == seshKey && t.Direction == TransferInbound {
+				if state := t.State(); state != TransferComplete && state != TransferErrored {
+					open++
+				}
+			}
+			return true
+		})
+
+		if open >= limits.MaxConcurrent {
+			return fmt.Errorf("%w: %d transfers are already open for the session", ErrLimitExceeded, open)
+		}
+
+	}
+
+	return nil
+
+}
+
+// maxBytes is the most an agreed transfer may carry, the size it was offered with or the configured limit
+func (tm *TransferManager) maxBytes(agreed TransferNegotiation) int64 {
+
+	if agreed.Size > 0 {
+		return agreed.Size
+	}
+
+	return tm.Limits.MaxBytes
+
+}
+
+// rateLimiter paces a stream of bytes to rate bytes per second, a nil or zero rate limiter never waits
+type rateLimiter struct {
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate}
+
+}
+
+// reserve books n bytes and returns when they may go, the bytes after them are booked from that point on
+func (rl *rateLimiter) reserve(n int) time.Time {
+
+	now := time.Now()
+
+	if rl == nil {
+		return now
+	}
+
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+
+	at := rl.next
+
+	rl.next = rl.next.Add(time.Duration(int64(n) * int64(time.Second) / rl.rate))
+
+	return at
+
+}
+
+// ready is when the next reservation may go
+func (rl *rateLimiter) ready() time.Time {
+
+	if rl == nil {
+		return time.Time{}
+	}
+
+	return rl.next
+
+}
@@ -0,0 +1,142 @@
+package go_wsutils
+
+import (
+	"github.com/768bit/websocket"
+	"github.com/google/uuid"
+	"sync"
+)
+
+// DefaultDispatchQueueSize is how many packets may wait for one transfer before Dispatch blocks the read loop
+var DefaultDispatchQueueSize = 64
+
+type dispatchKey struct {
+	conn    *websocket.Conn
+	seshKey uuid.UUID
+	id      uint64
+}
+
+// dispatchQueue feeds the packets of one session ID to its own goroutine, pending counts the packets handed to the
+// queue that have not been processed yet so the goroutine only exits once nothing more is on the way
+type dispatchQueue struct {
+	packets chan []byte
+	pending int
+}
+
+func DispatchByteStream(socketConn *websocket.Conn, data []byte) error {
+
+	return DefaultTransferManager.Dispatch(socketConn, data)
+
+}
+
+// Dispatch is HandleByteStream for a connection carrying many transfers at once - packets are queued by session ID
+// and each session ID is processed on its own goroutine, in the order its packets arrived. Only frames that can not
+// be attributed to a session are handled (and their error returned) straight away, errors from queued packets go to
+// OnDispatchError. data is copied so the caller may reuse its read buffer.
+func (tm *TransferManager) Dispatch(socketConn *websocket.Conn, data []byte) error {
+
+	header, _, err := DecodeFrame(data)
+
+	if err != nil {
+		return tm.HandleByteStream(socketConn, data)
+	}
+
+	key := dispatchKey{conn: socketConn, seshKey: header.SeshKey, id: header.SeshID}
+
+	tm.dispatchMu.Lock()
+
+	q, ok := tm.dispatch[key]
+
+	if !ok {
+
+		size := tm.DispatchQueueSize
+
+		if size <= 0 {
+			size = DefaultDispatchQueueSize
+		}
+
+		q = &dispatchQueue{packets: make(chan []byte, size)}
+		tm.dispatch[key] = q
+
+		go tm.serveDispatch(socketConn, key, q)
+
+	}
+
+	q.pending++
+
+	tm.dispatchMu.Unlock()
+
+	q.packets <- append([]byte(nil), data...)
+
+	return nil
+
+}
+
+func (tm *TransferManager) serveDispatch(socketConn *websocket.Conn, key dispatchKey, q *dispatchQueue) {
+
+	for data := range q.packets {
+
+		if err := tm.HandleByteStream(socketConn, data); err != nil && tm.OnDispatchError != nil {
+			tm.OnDispatchError(socketConn, key.id, err)
+		}
+
+		tm.dispatchMu.Lock()
+
+		q.pending--
+
+		if q.pending == 0 {
+			//nothing else is queued or about to be, the next packet for this session ID starts a new goroutine
+			delete(tm.dispatch, key)
+			tm.dispatchMu.Unlock()
+			return
+		}
+
+		tm.dispatchMu.Unlock()
+
+	}
+
+}
+
+// fairLock hands the lock over in the order it was asked for, senders that write a frame and immediately ask again go
+// to the back of the line so every transfer on a connection gets a frame out in turn
+type fairLock struct {
+	mu      sync.Mutex
+	held    bool
+	waiting []chan struct{}
+}
+
+func (l *fairLock) Lock() {
+
+	l.mu.Lock()
+
+	if !l.held {
+		l.held = true
+		l.mu.Unlock()
+		return
+	}
+
+	turn := make(chan struct{})
+	l.waiting = append(l.waiting, turn)
+
+	l.mu.Unlock()
+
+	<-turn
+
+}
+
+func (l *fairLock) Unlock() {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.waiting) == 0 {
+		l.held = false
+		return
+	}
+
+	//the lock passes straight to the next in line, it is never released in between
+	turn := l.waiting[0]
+	l.waiting = l.waiting[1:]
+
+	close(turn)
+
+}
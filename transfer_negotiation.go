@@ -0,0 +1,152 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// TransferMetadata describes what is being transferred so the receiver can decide what to do with it before any
+// of the data arrives, see TransferAcceptor
+type TransferMetadata struct {
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	//ChunkSize is the largest data packet the sender will send, larger packets are rejected
+	ChunkSize int `json:"chunkSize,omitempty"`
+	//Checksum names the digest the sender will send with TRANSFER_COMPLETE
+	Checksum string            `json:"checksum,omitempty"`
+	Custom   map[string]string `json:"custom,omitempty"`
+}
+
+// TransferNegotiation is carried as JSON in the NEGOTIATE_TRANSFER payload to say what the sender would like to
+// use, the receiver answers in NEGOTIATE_TRANSFER_ACK with what it has agreed to
+type TransferNegotiation struct {
+	//Purpose picks the TransferHandler the receiver passes the data to
+	Purpose      string `json:"purpose,omitempty"`
+	FrameVersion uint8  `json:"frameVersion,omitempty"`
+	//ChunkChecksum is checked on every data packet, it needs version 2 frames to flag the packets that carry it
+	ChunkChecksum string `json:"chunkChecksum,omitempty"`
+	//Digest covers the whole transfer and is sent in TRANSFER_COMPLETE
+	Digest string `json:"digest,omitempty"`
+	//Compression is the codec each data packet may be compressed with, like ChunkChecksum it needs version 2 frames
+	Compression string `json:"compression,omitempty"`
+	//Encryption is the AEAD every data packet is sealed with, a receiver that can not encrypt refuses the transfer
+	//rather than let it go ahead in the clear. Salt is mixed into the key so no two transfers share one.
+	Encryption string `json:"encryption,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	//Size is the length of the transfer in bytes if the sender knows it, the transfer may not carry any more than this
+	Size int64 `json:"size,omitempty"`
+	//Rate is the most bytes per second the sender will send, the receiver may lower it
+	Rate int64 `json:"rate,omitempty"`
+	//Metadata is passed through to the receiver as it was sent
+	Metadata *TransferMetadata `json:"metadata,omitempty"`
+}
+
+// ParseTransferNegotiation decodes a negotiation payload, anything that is not a JSON object comes from a peer
+// that predates negotiation and gets the version 1 defaults
+func ParseTransferNegotiation(payload []byte) (TransferNegotiation, error) {
+
+	negotiation := TransferNegotiation{}
+
+	if len(payload) > 0 && payload[0] == '{' {
+		if err := json.Unmarshal(payload, &negotiation); err != nil {
+			return negotiation, fmt.Errorf("Unable to parse transfer negotiation: %s", err.Error())
+		}
+	}
+
+	if negotiation.FrameVersion == 0 {
+		negotiation.FrameVersion = FRAME_VERSION_1
+	}
+
+	if meta := negotiation.Metadata; meta != nil {
+
+		//the size in the metadata is the one the limits are checked against when the sender did not give both
+
+		if negotiation.Size == 0 {
+			negotiation.Size = meta.Size
+		} else if meta.Size != 0 && meta.Size != negotiation.Size {
+			return negotiation, fmt.Errorf("Transfer metadata gives a size of %d but %d was negotiated", meta.Size, negotiation.Size)
+		}
+
+		if meta.ChunkSize < 0 {
+			return negotiation, fmt.Errorf("Transfer metadata gives an invalid chunk size of %d", meta.ChunkSize)
+		}
+
+	}
+
+	return negotiation, nil
+
+}
+
+func (n TransferNegotiation) MarshalPayload() ([]byte, error) {
+
+	return json.Marshal(n)
+
+}
+
+// accepts checks the receiver has not agreed to anything beyond what was offered
+func (n TransferNegotiation) accepts(agreed TransferNegotiation) error {
+
+	if agreed.Purpose != n.Purpose {
+		return fmt.Errorf("Peer agreed to a transfer for %q but %q was offered", agreed.Purpose, n.Purpose)
+	} else if agreed.FrameVersion > n.FrameVersion {
+		return fmt.Errorf("Peer agreed to frame version %d but only %d was offered", agreed.FrameVersion, n.FrameVersion)
+	} else if agreed.ChunkChecksum != "" && agreed.ChunkChecksum != n.ChunkChecksum {
+		return fmt.Errorf("Peer agreed to %s checksums which were not offered", agreed.ChunkChecksum)
+	} else if agreed.Digest != "" && agreed.Digest != n.Digest {
+		return fmt.Errorf("Peer agreed to a %s digest which was not offered", agreed.Digest)
+	} else if agreed.Compression != "" && agreed.Compression != n.Compression {
+		return fmt.Errorf("Peer agreed to %s compression which was not offered", agreed.Compression)
+	} else if agreed.Encryption != n.Encryption || !bytes.Equal(agreed.Salt, n.Salt) {
+		return fmt.Errorf("Peer agreed to %q encryption but %q was offered", agreed.Encryption, n.Encryption)
+	} else if agreed.Size != n.Size {
+		return fmt.Errorf("Peer agreed to a transfer of %d bytes but %d was offered", agreed.Size, n.Size)
+	} else if agreed.Rate < 0 || (n.Rate > 0 && (agreed.Rate == 0 || agreed.Rate > n.Rate)) {
+		return fmt.Errorf("Peer agreed to %d bytes per second but at most %d was offered", agreed.Rate, n.Rate)
+	}
+
+	return nil
+
+}
+
+func (tm *TransferManager) maxFrameVersion() uint8 {
+
+	if tm.MaxFrameVersion == 0 {
+		return FRAME_VERSION_2
+	}
+
+	return tm.MaxFrameVersion
+
+}
+
+// negotiate settles a requested transfer against what this side supports
+func (tm *TransferManager) negotiate(requested TransferNegotiation) TransferNegotiation {
+
+	agreed := requested
+
+	if agreed.FrameVersion > tm.maxFrameVersion() {
+		agreed.FrameVersion = tm.maxFrameVersion()
+	}
+
+	//anything we do not support is declined rather than refused, the transfer just goes ahead without it
+
+	if agreed.ChunkChecksum != ChecksumCRC32C || agreed.FrameVersion < FRAME_VERSION_2 {
+		agreed.ChunkChecksum = ""
+	}
+
+	if agreed.Digest != DigestSHA256 {
+		agreed.Digest = ""
+	}
+
+	if !isCompressionCodec(agreed.Compression) || agreed.FrameVersion < FRAME_VERSION_2 {
+		agreed.Compression = ""
+	}
+
+	if limit := tm.Limits.BytesPerSecond; limit > 0 && (agreed.Rate <= 0 || agreed.Rate > limit) {
+		agreed.Rate = limit
+	}
+
+	return agreed
+
+}
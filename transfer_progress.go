@@ -0,0 +1,128 @@
+package go_wsutils
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrTransferCancelled = errors.New("Transfer was cancelled with its request")
+
+// DefaultProgressTimeout is how long the final update of a transfer waits for the Progress channel to be read
+var DefaultProgressTimeout = 30 * time.Second
+
+// transferProgress reports a transfer through the Progress channel of the WSRequest it is tied to, so a UI can
+// treat it like any other request. Updates are only sent when the whole percent changes and never hold the
+// transfer up - an update nobody is waiting on is dropped in favour of the next one. The final update, 100 percent
+// or the error, is delivered in the background.
+type transferProgress struct {
+	req     *WSRequest
+	percent int
+	last    float32
+}
+
+// TrackProgress ties the transfer to req, Percent is updated as the peer acknowledges data (outbound) or as data
+// arrives (inbound) and reaches 100 when the transfer completes. Percent can only be worked out for a transfer
+// negotiated with a Size, without one only completion or the error is reported. Cancelling req stops the transfer.
+// A transfer that has already finished, as an inbound one may have by the time its handler runs, reports how it
+// ended straight away.
+func (t *Transfer) TrackProgress(req *WSRequest) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if req == nil {
+		t.progress = nil
+		return
+	}
+
+	t.progress = &transferProgress{req: req, percent: -1}
+
+	switch t.state {
+	case TransferComplete:
+		t.progress.finish(nil)
+	case TransferErrored:
+		t.progress.finish(t.err)
+	}
+
+}
+
+// cancelled is closed when the request the transfer is tied to is cancelled, it is nil (and so never ready) for a
+// transfer that is not tied to one
+func (t *Transfer) cancelled() <-chan struct{} {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.progress == nil {
+		return nil
+	}
+
+	return t.progress.req.CancelSignal()
+
+}
+
+// progressed records that done bytes have been moved, it returns false once the request has been cancelled
+func (t *Transfer) progressed(done int64) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.progress
+
+	if p == nil {
+		return true
+	} else if p.req.isCancelled() {
+		return false
+	}
+
+	total := t.negotiation.Size
+
+	if total <= 0 || done >= total {
+		//100 percent is left for when the transfer has actually completed
+		return true
+	}
+
+	percent := int(done * 100 / total)
+
+	if percent <= p.percent {
+		return true
+	}
+
+	p.percent = percent
+	p.last = float32(done) * 100 / float32(total)
+
+	p.offer(&WSRequestProgress{Percent: p.last, StatusCode: RPCStatusOK})
+
+	return true
+
+}
+
+// finish sends the final update for the transfer, t.mu must be held
+func (p *transferProgress) finish(err error) {
+
+	if p == nil {
+		return
+	}
+
+	progress := &WSRequestProgress{Percent: 100, StatusCode: RPCStatusOK}
+
+	if err != nil {
+		progress = &WSRequestProgress{Percent: p.last, StatusCode: RPCStatusError, Error: err}
+	}
+
+	go p.deliver(progress, DefaultProgressTimeout)
+
+}
+
+// offer sends an update only if the request is being read right now
+func (p *transferProgress) offer(progress *WSRequestProgress) {
+
+	p.req.sendProgress(progress, 0)
+
+}
+
+func (p *transferProgress) deliver(progress *WSRequestProgress, timeout time.Duration) {
+
+	p.req.sendProgress(progress, timeout)
+
+}
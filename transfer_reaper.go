@@ -0,0 +1,157 @@
+package go_wsutils
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultTransferIdleTimeout is how long a transfer may go without a packet before the reaper expires it
+var DefaultTransferIdleTimeout = 2 * time.Minute
+
+// DefaultReaperInterval is how often the reaper looks for idle transfers
+var DefaultReaperInterval = 15 * time.Second
+
+// transferReaper is the background loop started by StartReaper
+type transferReaper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (tm *TransferManager) idleTimeout() time.Duration {
+
+	if tm.IdleTimeout <= 0 {
+		return DefaultTransferIdleTimeout
+	}
+
+	return tm.IdleTimeout
+
+}
+
+// StartReaper expires idle transfers every interval (DefaultReaperInterval when interval is 0) until StopReaper is
+// called, starting it again replaces the running reaper
+func (tm *TransferManager) StartReaper(interval time.Duration) {
+
+	if interval <= 0 {
+		interval = DefaultReaperInterval
+	}
+
+	tm.StopReaper()
+
+	r := &transferReaper{stop: make(chan struct{}), done: make(chan struct{})}
+
+	tm.reaperMu.Lock()
+	tm.reaper = r
+	tm.reaperMu.Unlock()
+
+	go func() {
+
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				tm.Reap()
+			}
+		}
+
+	}()
+
+}
+
+// StopReaper stops the reaper started by StartReaper and waits for a pass that is under way to finish
+func (tm *TransferManager) StopReaper() {
+
+	tm.reaperMu.Lock()
+	r := tm.reaper
+	tm.reaper = nil
+	tm.reaperMu.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.done
+
+}
+
+// Reap expires every transfer that has not seen a packet for IdleTimeout and returns how many it expired. The
+// peer is sent TRANSFER_ERROR if the transfer still has a connection, its buffers are released and
+// OnTransferExpired is called. Finished transfers that were left in the store are dropped without any of that.
+func (tm *TransferManager) Reap() int {
+
+	idle := tm.idleTimeout()
+	now := time.Now()
+
+	var expired, finished []*Transfer
+
+	tm.Store.Range(func(t *Transfer) bool {
+		if now.Sub(t.LastActive()) > idle {
+			if state := t.State(); state == TransferComplete || state == TransferErrored {
+				finished = append(finished, t)
+			} else {
+				expired = append(expired, t)
+			}
+		}
+		return true
+	})
+
+	for _, t := range finished {
+		tm.removeTransfer(t)
+	}
+
+	count := 0
+
+	for _, t := range expired {
+		if tm.expireTransfer(t, idle) {
+			count++
+		}
+	}
+
+	return count
+
+}
+
+// expireStored is handed to a store that expires transfers itself, a transfer that has already finished is just
+// dropped and any other is expired like the reaper would. Stores expire transfers from inside Get and Range, which
+// the manager calls on the read loop and with limitsMu held, so the peer is told and OnTransferExpired is called
+// from a goroutine of its own.
+func (tm *TransferManager) expireStored(t *Transfer, idle time.Duration) {
+
+	if state := t.State(); state == TransferComplete || state == TransferErrored {
+		return
+	}
+
+	go tm.expireTransfer(t, idle)
+
+}
+
+func (tm *TransferManager) expireTransfer(t *Transfer, idle time.Duration) bool {
+
+	if time.Since(t.LastActive()) <= idle {
+		//a packet came in since the store was walked
+		return false
+	}
+
+	err := streamError(TRANSFER_ERROR, StreamErrorTimeout, fmt.Errorf("%w: no packets for %s", ErrTransferExpired, idle))
+
+	t.fail(err)
+	tm.removeTransfer(t)
+
+	if socketConn := t.Conn(); socketConn != nil {
+		//the peer may already be gone, there is nothing more to do about it if the error can not be sent
+		SendStreamError(socketConn, t.ID, t.Seq(), parseSeshKey(t.SeshKey), TRANSFER_ERROR, err)
+	}
+
+	if tm.OnTransferExpired != nil {
+		tm.OnTransferExpired(t, err)
+	}
+
+	return true
+
+}
@@ -0,0 +1,479 @@
+package go_wsutils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/768bit/websocket"
+	"github.com/google/uuid"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+var DefaultTransferChunkSize = 32 * 1024
+var DefaultNegotiateTimeout = 30 * time.Second
+var DefaultAckTimeout = 5 * time.Second
+var DefaultTransferWindow = 16
+var DefaultMaxRetransmits = 5
+var DefaultResumeTimeout = 2 * time.Minute
+
+// DefaultCompleteTimeout is how long the sender waits for the peer's handler to take a transfer once every packet
+// has been acknowledged
+var DefaultCompleteTimeout = 2 * time.Minute
+
+type TransferStats struct {
+	Started     time.Time
+	Elapsed     time.Duration
+	Packets     uint64
+	Retransmits uint64
+	BytesSent   int64
+	BytesAcked  int64
+}
+
+// Throughput is the acknowledged bytes per second over the life of the transfer
+func (s TransferStats) Throughput() float64 {
+
+	if s.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(s.BytesAcked) / s.Elapsed.Seconds()
+
+}
+
+type inflightPacket struct {
+	payload []byte
+	flags   uint8
+	size    int
+	sentAt  time.Time
+	retries int
+}
+
+// TransferSender streams an io.Reader to the peer as a sequence of TRANSFER_CHUNK packets, at most Window packets
+// are left unacknowledged at a time and any packet not acknowledged within AckTimeout is sent again
+type TransferSender struct {
+	manager          *TransferManager
+	conn             *websocket.Conn
+	seshKey          uuid.UUID
+	ID               uint64
+	ChunkSize        int
+	Window           int
+	NegotiateTimeout time.Duration
+	AckTimeout       time.Duration
+	MaxRetransmits   int
+	//ResumeTimeout is how long to wait for the transfer to be resumed after its connection drops
+	ResumeTimeout time.Duration
+	//CompleteTimeout is how long to wait for the final ack of a transfer that confirms completion
+	CompleteTimeout time.Duration
+	//Negotiation is offered to the peer with NEGOTIATE_TRANSFER
+	Negotiation TransferNegotiation
+	//Request has its Progress updated as the peer acknowledges the data, see Transfer.TrackProgress
+	Request *WSRequest
+	statsMu sync.Mutex
+	stats   TransferStats
+}
+
+func (tm *TransferManager) NewTransferSender(socketConn *websocket.Conn, id uint64, seshKey uuid.UUID) *TransferSender {
+
+	return &TransferSender{
+		manager:          tm,
+		conn:             socketConn,
+		seshKey:          seshKey,
+		ID:               id,
+		ChunkSize:        DefaultTransferChunkSize,
+		Window:           DefaultTransferWindow,
+		NegotiateTimeout: DefaultNegotiateTimeout,
+		AckTimeout:       DefaultAckTimeout,
+		MaxRetransmits:   DefaultMaxRetransmits,
+		ResumeTimeout:    DefaultResumeTimeout,
+		CompleteTimeout:  DefaultCompleteTimeout,
+	}
+
+}
+
+// SendStream negotiates a transfer with the peer and streams r to it using the default sender settings
+func (tm *TransferManager) SendStream(socketConn *websocket.Conn, id uint64, seshKey uuid.UUID, r io.Reader) error {
+
+	return tm.NewTransferSender(socketConn, id, seshKey).Send(r)
+
+}
+
+func SendStream(socketConn *websocket.Conn, id uint64, seshKey uuid.UUID, r io.Reader) error {
+
+	return DefaultTransferManager.SendStream(socketConn, id, seshKey, r)
+
+}
+
+func (ts *TransferSender) chunkSize(negotiation TransferNegotiation) int {
+
+	maxSize := MAX_PAYLOAD_SIZE
+
+	if negotiation.FrameVersion >= FRAME_VERSION_2 {
+		maxSize = MAX_PAYLOAD_SIZE_V2
+	}
+
+	if negotiation.ChunkChecksum != "" {
+		maxSize -= CRC32C_SIZE_BYTES
+	}
+
+	if negotiation.Encryption != "" {
+		maxSize -= ENCRYPTION_TAG_SIZE_BYTES
+	}
+
+	if ts.ChunkSize <= 0 {
+		return DefaultTransferChunkSize
+	} else if ts.ChunkSize > maxSize {
+		return maxSize
+	}
+
+	return ts.ChunkSize
+
+}
+
+func (ts *TransferSender) window() int {
+
+	if ts.Window <= 0 {
+		return 1
+	}
+
+	return ts.Window
+
+}
+
+func (ts *TransferSender) Stats() TransferStats {
+
+	ts.statsMu.Lock()
+	defer ts.statsMu.Unlock()
+
+	stats := ts.stats
+
+	if !stats.Started.IsZero() && stats.Elapsed == 0 {
+		stats.Elapsed = time.Since(stats.Started)
+	}
+
+	return stats
+
+}
+
+func (ts *TransferSender) updateStats(fn func(stats *TransferStats)) {
+
+	ts.statsMu.Lock()
+	defer ts.statsMu.Unlock()
+	fn(&ts.stats)
+
+}
+
+func (ts *TransferSender) Send(r io.Reader) error {
+
+	offer := ts.Negotiation
+
+	if sized, ok := r.(interface{ Len() int }); ok && offer.Size == 0 {
+		//readers that know what is left (bytes.Reader, strings.Reader...) let the peer check its limits up front
+		offer.Size = int64(sized.Len())
+	}
+
+	if offer.Metadata != nil {
+
+		meta := *offer.Metadata
+
+		if meta.Size == 0 {
+			meta.Size = offer.Size
+		} else if offer.Size == 0 {
+			offer.Size = meta.Size
+		}
+
+		if meta.ChunkSize == 0 {
+			meta.ChunkSize = ts.chunkSize(offer)
+		}
+
+		if meta.Checksum == "" {
+			meta.Checksum = offer.Digest
+		}
+
+		offer.Metadata = &meta
+
+	}
+
+	t, err := ts.manager.OpenTransfer(ts.conn, ts.ID, ts.seshKey, offer)
+
+	if err != nil {
+		return err
+	}
+
+	t.TrackProgress(ts.Request)
+
+	if err := t.waitUntil(func() bool { return t.state != TransferNegotiating }, ts.NegotiateTimeout); err != nil {
+		t.fail(err)
+		ts.manager.removeTransfer(t)
+		return err
+	} else if err := ts.manager.BeginTransfer(ts.conn, t, ts.seshKey); err != nil {
+		return err
+	}
+
+	ts.updateStats(func(stats *TransferStats) {
+		*stats = TransferStats{Started: time.Now()}
+	})
+
+	defer ts.updateStats(func(stats *TransferStats) {
+		stats.Elapsed = time.Since(stats.Started)
+	})
+
+	negotiation := t.Negotiation()
+
+	var digest hash.Hash
+
+	if negotiation.Digest == DigestSHA256 {
+		digest = sha256.New()
+	}
+
+	chunkSize := ts.chunkSize(negotiation)
+
+	if meta := negotiation.Metadata; meta != nil && meta.ChunkSize > 0 && meta.ChunkSize < chunkSize {
+		//never send more than the metadata promised, the frame version agreed may have left room for bigger packets
+		chunkSize = meta.ChunkSize
+	}
+
+	inflight := map[uint64]*inflightPacket{}
+
+	pace := newRateLimiter(negotiation.Rate)
+
+	cancelled := t.cancelled()
+
+	var seq uint64
+	var acked int64
+	var read int64
+
+	eof := false
+
+	for !eof || len(inflight) > 0 {
+
+		//grab the notification channel before looking at the acks so an ack landing in between still wakes us
+
+		changed := t.changed()
+
+		if t.State() == TransferErrored {
+			return t.Err()
+		}
+
+		if t.Conn() == nil {
+
+			//the connection went away, wait for the peer to resume and then resend everything it has not acknowledged
+
+			if err := t.waitUntil(func() bool { return t.conn != nil }, ts.ResumeTimeout); err != nil {
+				t.fail(err)
+				ts.manager.removeTransfer(t)
+				return err
+			}
+
+			for _, packet := range inflight {
+				packet.sentAt = time.Time{}
+				packet.retries = 0
+			}
+
+			continue
+
+		}
+
+		for ackSeq, packet := range inflight {
+			if t.isAcked(ackSeq) {
+				delete(inflight, ackSeq)
+				acked += int64(packet.size)
+				ts.updateStats(func(stats *TransferStats) {
+					stats.BytesAcked += int64(packet.size)
+				})
+			}
+		}
+
+		if !t.progressed(acked) {
+			return ts.manager.rejectTransfer(t.Conn(), t, ts.ID, seq, ts.seshKey, ErrTransferCancelled)
+		}
+
+		for !eof && len(inflight) < ts.window() && !time.Now().Before(pace.ready()) {
+
+			buf := make([]byte, chunkSize)
+
+			n, readErr := io.ReadFull(r, buf)
+
+			if n > 0 {
+
+				seq++
+
+				read += int64(n)
+
+				if digest != nil {
+					digest.Write(buf[:n])
+				}
+
+				payload, flags := t.sealChunk(seq, buf[:n])
+
+				packet := &inflightPacket{payload: payload, flags: flags, size: n}
+
+				inflight[seq] = packet
+
+				ts.transmit(t, seq, packet)
+
+				pace.reserve(n)
+
+				ts.updateStats(func(stats *TransferStats) {
+					stats.BytesSent += int64(n)
+				})
+
+			}
+
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				eof = true
+			} else if readErr != nil {
+				return ts.manager.rejectTransfer(t.Conn(), t, ts.ID, seq, ts.seshKey, readErr)
+			}
+
+		}
+
+		//still short of the window with data left to read means the rate is holding us back
+		paced := !eof && len(inflight) < ts.window()
+
+		if len(inflight) == 0 && !paced {
+			continue
+		}
+
+		now := time.Now()
+		wake := now.Add(ts.AckTimeout)
+
+		if paced && pace.ready().Before(wake) {
+			wake = pace.ready()
+		}
+
+		for inflightSeq, packet := range inflight {
+
+			deadline := packet.sentAt.Add(ts.AckTimeout)
+
+			if deadline.After(now) {
+				if deadline.Before(wake) {
+					wake = deadline
+				}
+				continue
+			}
+
+			if packet.retries >= ts.MaxRetransmits {
+				return ts.manager.rejectTransfer(t.Conn(), t, ts.ID, inflightSeq, ts.seshKey, streamError(TRANSFER_ERROR, StreamErrorTimeout, fmt.Errorf("Packet %d was not acknowledged after %d retransmits", inflightSeq, packet.retries)))
+			}
+
+			packet.retries++
+
+			ts.updateStats(func(stats *TransferStats) {
+				stats.Retransmits++
+			})
+
+			ts.transmit(t, inflightSeq, packet)
+
+		}
+
+		timer := time.NewTimer(time.Until(wake))
+
+		select {
+		case <-changed:
+		case <-cancelled:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+
+	}
+
+	if negotiation.Size > 0 && read != negotiation.Size {
+		//the peer would refuse it at the terminator anyway
+		return ts.manager.rejectTransfer(t.Conn(), t, ts.ID, seq+1, ts.seshKey, fmt.Errorf("%w: the reader gave %d of the %d bytes negotiated", ErrTransferIncomplete, read, negotiation.Size))
+	}
+
+	var sum []byte
+
+	if digest != nil {
+		sum = digest.Sum(nil)
+	}
+
+	completeTimeout := ts.CompleteTimeout
+
+	if completeTimeout <= 0 {
+		completeTimeout = DefaultCompleteTimeout
+	}
+
+	return ts.manager.endTransfer(t.Conn(), t, seq+1, ts.seshKey, sum, completeTimeout)
+
+}
+
+func (ts *TransferSender) transmit(t *Transfer, seq uint64, packet *inflightPacket) {
+
+	packet.sentAt = time.Now()
+
+	socketConn := t.Conn()
+
+	if socketConn == nil {
+		return
+	}
+
+	var err error
+
+	if t.Negotiation().FrameVersion >= FRAME_VERSION_2 {
+		err = SendStreamCmdRequestV2(socketConn, ts.ID, seq, ts.seshKey, TRANSFER_CHUNK, packet.flags, packet.payload)
+	} else {
+		err = SendStreamCmdRequest(socketConn, ts.ID, seq, ts.seshKey, TRANSFER_CHUNK, packet.payload)
+	}
+
+	if err != nil {
+		//leave the packet in flight, it is sent again once the transfer has been resumed on a new connection
+		t.detach(socketConn)
+		return
+	}
+
+	ts.updateStats(func(stats *TransferStats) {
+		stats.Packets++
+	})
+
+}
+
+// endTransfer sends the terminator for a fully acknowledged outbound transfer and drops it from the store, when a
+// digest was negotiated it is sent in a TRANSFER_COMPLETE packet in place of the 37 byte terminator (sealed when
+// encryption was agreed). A transfer that confirms completion is only done once the peer acknowledges the
+// terminator, which it does after its handler has taken the data.
+func (tm *TransferManager) endTransfer(socketConn *websocket.Conn, t *Transfer, seq uint64, seshKey uuid.UUID, digest []byte, ackTimeout time.Duration) error {
+
+	if t.Direction != TransferOutbound {
+		return errors.New("Only outbound transfers can be ended locally")
+	}
+
+	var err error
+
+	if digest != nil {
+		err = SendStreamCmdRequest(socketConn, t.ID, seq, seshKey, TRANSFER_COMPLETE, t.sealDigest(seq, digest))
+	} else {
+		err = SendStreamTerminator(socketConn, t.ID, seq, seshKey)
+	}
+
+	if err == nil && confirmsCompletion(t.Negotiation()) {
+		err = t.waitUntil(func() bool { return t.acked >= seq }, ackTimeout)
+	}
+
+	if err != nil {
+		t.fail(err)
+		tm.removeTransfer(t)
+		return err
+	}
+
+	if err := t.transition(TransferStreaming, TransferComplete, seq); err != nil {
+		return err
+	}
+
+	tm.removeTransfer(t)
+
+	return nil
+
+}
+
+// confirmsCompletion reports whether the receiver acknowledges the terminator, peers that only speak version 1
+// frames and did not negotiate a digest never do
+func confirmsCompletion(negotiation TransferNegotiation) bool {
+
+	return negotiation.Digest != "" || negotiation.FrameVersion >= FRAME_VERSION_2
+
+}
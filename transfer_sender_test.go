@@ -0,0 +1,217 @@
+package go_wsutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func receiveTransfers(tm *TransferManager) chan []byte {
+
+	received := make(chan []byte, 1)
+
+	tm.HandleFunc("", func(tr *Transfer, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		received <- data
+		return err
+	})
+
+	return received
+
+}
+
+func TestSenderWindow(t *testing.T) {
+
+	server, client := NewTransferManager(), NewTransferManager()
+	received := receiveTransfers(server)
+
+	var highest atomic.Uint64
+	var release atomic.Bool
+
+	serverKeep := func(header FrameHeader) bool {
+		if header.Cmd == TRANSFER_CHUNK && header.SeqID > highest.Load() {
+			highest.Store(header.SeqID)
+		}
+		return true
+	}
+
+	clientKeep := func(header FrameHeader) bool {
+		return header.Cmd != TRANSFER_SEQ_ACK || release.Load()
+	}
+
+	_, clientConn := filteredLoopbackPair(t, server, client, serverKeep, clientKeep)
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	sender := client.NewTransferSender(clientConn, 1, testSeshKey)
+	sender.ChunkSize = 100
+	sender.Window = 2
+	sender.AckTimeout = 300 * time.Millisecond
+
+	sent := make(chan error, 1)
+
+	go func() {
+		sent <- sender.Send(bytes.NewReader(data))
+	}()
+
+	//with every ack lost the sender has to stop once the window is full
+
+	time.Sleep(100 * time.Millisecond)
+
+	if seq := highest.Load(); seq != 2 {
+		t.Fatalf("sent up to packet %d with a window of 2", seq)
+	}
+
+	release.Store(true)
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(<-received, data) {
+		t.Fatal("received data does not match")
+	}
+
+}
+
+func TestSenderRetransmit(t *testing.T) {
+
+	server, client := NewTransferManager(), NewTransferManager()
+	received := receiveTransfers(server)
+
+	var mu sync.Mutex
+	var retransmitted atomic.Bool
+
+	seen := map[uint64]bool{}
+
+	serverKeep := func(header FrameHeader) bool {
+		if header.Cmd == TRANSFER_CHUNK {
+			mu.Lock()
+			if seen[header.SeqID] {
+				retransmitted.Store(true)
+			}
+			seen[header.SeqID] = true
+			mu.Unlock()
+		}
+		return true
+	}
+
+	//acks are lost until a packet has been sent again
+	clientKeep := func(header FrameHeader) bool {
+		return header.Cmd != TRANSFER_SEQ_ACK || retransmitted.Load()
+	}
+
+	_, clientConn := filteredLoopbackPair(t, server, client, serverKeep, clientKeep)
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	sender := client.NewTransferSender(clientConn, 1, testSeshKey)
+	sender.ChunkSize = 100
+	sender.Window = 4
+	sender.AckTimeout = 50 * time.Millisecond
+
+	if err := sender.Send(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(<-received, data) {
+		t.Fatal("received data does not match")
+	}
+
+	if stats := sender.Stats(); stats.Retransmits == 0 || stats.BytesAcked != int64(len(data)) {
+		t.Fatalf("%+v", stats)
+	}
+
+}
+
+func TestSenderMaxRetransmits(t *testing.T) {
+
+	server, client := NewTransferManager(), NewTransferManager()
+	receiveTransfers(server)
+
+	clientKeep := func(header FrameHeader) bool {
+		return header.Cmd != TRANSFER_SEQ_ACK
+	}
+
+	_, clientConn := filteredLoopbackPair(t, server, client, nil, clientKeep)
+
+	sender := client.NewTransferSender(clientConn, 1, testSeshKey)
+	sender.ChunkSize = 100
+	sender.Window = 1
+	sender.AckTimeout = 20 * time.Millisecond
+	sender.MaxRetransmits = 2
+
+	err := sender.Send(bytes.NewReader(make([]byte, 1000)))
+
+	var streamErr *StreamError
+
+	if !errors.As(err, &streamErr) || streamErr.Code != StreamErrorTimeout {
+		t.Fatalf("got %v", err)
+	} else if retransmits := sender.Stats().Retransmits; retransmits != 2 {
+		t.Fatalf("%d retransmits", retransmits)
+	}
+
+	if tr := client.Transfer(seshKeyString(testSeshKey), 1); tr != nil {
+		t.Fatal("the failed transfer was left in the store")
+	}
+
+}
+
+func TestSenderResume(t *testing.T) {
+
+	server, client := NewTransferManager(), NewTransferManager()
+	received := receiveTransfers(server)
+
+	var chunks atomic.Int32
+
+	cut := make(chan struct{})
+
+	//the first connection goes quiet after 10 packets, nothing the client sends gets through
+	serverKeep := func(header FrameHeader) bool {
+		if header.Cmd == TRANSFER_CHUNK && chunks.Add(1) == 10 {
+			close(cut)
+		}
+		return chunks.Load() <= 10
+	}
+
+	_, clientConn := filteredLoopbackPair(t, server, client, serverKeep, nil)
+
+	data := make([]byte, 200000)
+	rand.Read(data)
+
+	sender := client.NewTransferSender(clientConn, 1, testSeshKey)
+	sender.ChunkSize = 4000
+	sender.Window = 8
+	sender.AckTimeout = 200 * time.Millisecond
+
+	sent := make(chan error, 1)
+
+	go func() {
+		sent <- sender.Send(bytes.NewReader(data))
+	}()
+
+	<-cut
+
+	//the client's read loop detaches the dropped connection and the transfer waits to be resumed
+	clientConn.Close()
+
+	_, resumeConn := loopbackPair(t, server, client)
+
+	seq, err := client.ResumeTransfer(resumeConn, 1, testSeshKey, time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	} else if seq > 10 {
+		t.Fatalf("resumed after packet %d when only 10 got through", seq)
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(<-received, data) {
+		t.Fatal("received data does not match")
+	}
+
+}
@@ -0,0 +1,132 @@
+package go_wsutils
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// DefaultSpillThreshold is how much of an inbound transfer is held in memory waiting on its handler before the
+// rest is written to a temporary file
+var DefaultSpillThreshold int64 = 8 * 1024 * 1024
+
+var ErrTransferExpired = errors.New("Transfer expired")
+var ErrSessionEnded = errors.New("Session ended")
+
+// spillFile is the part of a transferBuffer that has been moved to disk, it is written at the end and read from
+// the front like the in memory buffer it stands in for
+type spillFile struct {
+	dir   string
+	file  *os.File
+	read  int64
+	write int64
+}
+
+// Len is how many bytes are on disk waiting to be read
+func (sf *spillFile) Len() int64 {
+
+	return sf.write - sf.read
+
+}
+
+func (sf *spillFile) Write(p []byte) (int, error) {
+
+	if sf.file == nil {
+
+		file, err := os.CreateTemp(sf.dir, "go_wsutils-transfer-*")
+
+		if err != nil {
+			return 0, err
+		}
+
+		sf.file = file
+
+	}
+
+	n, err := sf.file.WriteAt(p, sf.write)
+
+	sf.write += int64(n)
+
+	return n, err
+
+}
+
+func (sf *spillFile) Read(p []byte) (int, error) {
+
+	if sf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > sf.Len() {
+		p = p[:sf.Len()]
+	}
+
+	n, err := sf.file.ReadAt(p, sf.read)
+
+	sf.read += int64(n)
+
+	if n > 0 {
+		err = nil
+	}
+
+	if sf.Len() == 0 {
+		//everything on disk has been read, start again from the front rather than letting the file grow
+		sf.read, sf.write = 0, 0
+		if truncErr := sf.file.Truncate(0); truncErr != nil {
+			sf.remove()
+		}
+	}
+
+	return n, err
+
+}
+
+// remove deletes the file, anything that was still on disk is lost
+func (sf *spillFile) remove() {
+
+	if sf.file == nil {
+		return
+	}
+
+	sf.file.Close()
+	os.Remove(sf.file.Name())
+
+	sf.file = nil
+	sf.read, sf.write = 0, 0
+
+}
+
+// spillThreshold is the threshold inbound transfers are assembled with, a negative SpillThreshold keeps
+// everything in memory
+func (tm *TransferManager) spillThreshold() int64 {
+
+	if tm.SpillThreshold == 0 {
+		return DefaultSpillThreshold
+	} else if tm.SpillThreshold < 0 {
+		return 0
+	}
+
+	return tm.SpillThreshold
+
+}
+
+// EndSession fails every transfer under seshKey and forgets them, their buffers and any temporary files are
+// released. Call it when a session ends for good - transfers over a connection that has only dropped are
+// left to DetachConn so they can be resumed.
+func (tm *TransferManager) EndSession(seshKey string) {
+
+	var ended []*Transfer
+
+	tm.Store.Range(func(t *Transfer) bool {
+		if t.SeshKey == seshKey {
+			ended = append(ended, t)
+		}
+		return true
+	})
+
+	for _, t := range ended {
+		t.fail(ErrSessionEnded)
+		tm.removeTransfer(t)
+	}
+
+}
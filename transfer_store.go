@@ -0,0 +1,147 @@
+package go_wsutils
+
+import (
+	"sync"
+	"time"
+)
+
+var DefaultTransferSessionExpiry = 5 * time.Minute
+
+// TransferSessionStore holds the transfers for every connection, keyed by TransferKey
+type TransferSessionStore interface {
+	Get(key string) (*Transfer, bool)
+	Put(t *Transfer)
+	Delete(key string)
+	Range(fn func(t *Transfer) bool)
+}
+
+// ExpiringTransferSessionStore is a store that drops idle transfers itself, NewTransferManagerWithStore hands it the
+// manager's expiry so the peer is told and OnTransferExpired is called just as when the reaper finds them
+type ExpiringTransferSessionStore interface {
+	TransferSessionStore
+	SetExpireFunc(fn func(t *Transfer, idle time.Duration))
+}
+
+type MemoryTransferSessionStore struct {
+	mu       sync.Mutex
+	expiry   time.Duration
+	expire   func(t *Transfer, idle time.Duration)
+	sessions map[string]*Transfer
+}
+
+// NewMemoryTransferSessionStore keeps transfers in a map, any transfer that has been idle for longer than expiry is
+// dropped and passed to the expire func, or failed with ErrTransferExpired when there is none (an expiry of 0 keeps
+// them forever)
+func NewMemoryTransferSessionStore(expiry time.Duration) *MemoryTransferSessionStore {
+
+	return &MemoryTransferSessionStore{
+		expiry:   expiry,
+		sessions: map[string]*Transfer{},
+	}
+
+}
+
+// SetExpireFunc sets what is done with the transfers the store expires, it is called without the store locked
+func (ms *MemoryTransferSessionStore) SetExpireFunc(fn func(t *Transfer, idle time.Duration)) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expire = fn
+
+}
+
+func (ms *MemoryTransferSessionStore) expired(t *Transfer, now time.Time) bool {
+
+	return ms.expiry > 0 && now.Sub(t.LastActive()) > ms.expiry
+
+}
+
+func (ms *MemoryTransferSessionStore) Get(key string) (*Transfer, bool) {
+
+	ms.mu.Lock()
+
+	t, ok := ms.sessions[key]
+
+	if ok && ms.expired(t, time.Now()) {
+		delete(ms.sessions, key)
+		expire := ms.expire
+		ms.mu.Unlock()
+		ms.expireTransfer(expire, t)
+		return nil, false
+	}
+
+	ms.mu.Unlock()
+
+	return t, ok
+
+}
+
+func (ms *MemoryTransferSessionStore) Put(t *Transfer) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sessions[t.Key()] = t
+
+}
+
+func (ms *MemoryTransferSessionStore) Delete(key string) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, key)
+
+}
+
+func (ms *MemoryTransferSessionStore) Range(fn func(t *Transfer) bool) {
+
+	now := time.Now()
+
+	ms.mu.Lock()
+
+	transfers := make([]*Transfer, 0, len(ms.sessions))
+	expired := []*Transfer{}
+
+	for key, t := range ms.sessions {
+		if ms.expired(t, now) {
+			delete(ms.sessions, key)
+			expired = append(expired, t)
+		} else {
+			transfers = append(transfers, t)
+		}
+	}
+
+	expire := ms.expire
+
+	ms.mu.Unlock()
+
+	for _, t := range expired {
+		ms.expireTransfer(expire, t)
+	}
+
+	//call out without holding the lock so fn is free to use the store
+
+	for _, t := range transfers {
+		if !fn(t) {
+			return
+		}
+	}
+
+}
+
+func (ms *MemoryTransferSessionStore) expireTransfer(expire func(t *Transfer, idle time.Duration), t *Transfer) {
+
+	if expire != nil {
+		expire(t, ms.expiry)
+	} else {
+		t.fail(ErrTransferExpired)
+	}
+
+}
+
+func (ms *MemoryTransferSessionStore) Len() int {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.sessions)
+
+}
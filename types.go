@@ -3,6 +3,8 @@ package go_wsutils
 import (
 	"context"
 	"github.com/768bit/websocket"
+	"math"
+	"sync"
 	"time"
 )
 
@@ -28,10 +30,54 @@ var HEADER_SIZE = (uint16)(SESH_ID_HEADER_SIZE_BYTES +
 	CMD_ID_HEADER_SIZE_BYTES +
 	PAYLOAD_LENGTH_HEADER_SIZE_BYTES)
 
+// the inbound length check adds the payload length to HEADER_SIZE as a uint16 so the whole packet must fit in one
+var MAX_PAYLOAD_SIZE = 0xFFFF - int(HEADER_SIZE)
+
+// version 2 frames set the top bit of the command and follow it with a version byte, a flags byte and a 32 bit payload length
+var FRAME_VERSION_1 = (uint8)(0x01)
+var FRAME_VERSION_2 = (uint8)(0x02)
+var FRAME_V2_CMD_FLAG = (uint16)(0x8000)
+var VERSION_HEADER_SIZE_BYTES = 1
+var VERSION_HEADER_INDEX_START = CMD_ID_HEADER_INDEX_END + 1
+var VERSION_HEADER_INDEX_END = VERSION_HEADER_INDEX_START + VERSION_HEADER_SIZE_BYTES - 1
+var FLAGS_HEADER_SIZE_BYTES = 1
+var FLAGS_HEADER_INDEX_START = VERSION_HEADER_INDEX_END + 1
+var FLAGS_HEADER_INDEX_END = FLAGS_HEADER_INDEX_START + FLAGS_HEADER_SIZE_BYTES - 1
+var PAYLOAD_LENGTH_V2_HEADER_SIZE_BYTES = 4
+var PAYLOAD_LENGTH_V2_HEADER_INDEX_START = FLAGS_HEADER_INDEX_END + 1
+var PAYLOAD_LENGTH_V2_HEADER_INDEX_END = PAYLOAD_LENGTH_V2_HEADER_INDEX_START + PAYLOAD_LENGTH_V2_HEADER_SIZE_BYTES - 1
+var HEADER_SIZE_V2 = (uint32)(SESH_ID_HEADER_SIZE_BYTES +
+	SEQ_ID_HEADER_SIZE_BYTES +
+	SESH_KEY_HEADER_SIZE_BYTES +
+	CMD_ID_HEADER_SIZE_BYTES +
+	VERSION_HEADER_SIZE_BYTES +
+	FLAGS_HEADER_SIZE_BYTES +
+	PAYLOAD_LENGTH_V2_HEADER_SIZE_BYTES)
+var MAX_PAYLOAD_SIZE_V2 = maxPayloadSizeV2()
+
+// maxPayloadSizeV2 is what the 32 bit length leaves after the header, held to the largest int where int is only 32
+// bits wide so it does not wrap around to a negative size
+func maxPayloadSizeV2() int {
+
+	size := uint64(0xFFFFFFFF - HEADER_SIZE_V2)
+
+	if size > math.MaxInt {
+		return math.MaxInt
+	}
+
+	return int(size)
+
+}
+
 var NEGOTIATE_TRANSFER = (uint16)(0x00)
 var NEGOTIATE_TRANSFER_ACK = (uint16)(0x04)
 var TRANSFER_BEGIN = (uint16)(0x08)
+var TRANSFER_CHUNK = (uint16)(0x0C)
 var TRANSFER_COMPLETE = (uint16)(0x10)
+var TRANSFER_RESUME = (uint16)(0x14)
+var TRANSFER_RESUME_ACK = (uint16)(0x18)
+var SESSION_KEY_ROTATE = (uint16)(0x1C)
+var SESSION_KEY_ROTATE_ACK = (uint16)(0x20)
 var TRANSFER_SEQ_ACK = (uint16)(0xAA)
 var NEGOTIATE_TRANSFER_ERROR = (uint16)(0xFA)
 var TRANSFER_ERROR = (uint16)(0xFB)
@@ -126,6 +172,7 @@ const (
 
 const (
 	RPCStatusOK               = 0x00C8 //200
+	RPCStatusBadRequest       = 0x0190 //400
 	RPCStatusUnauthorised     = 0x0191 //401
 	RPCStatusError            = 0x01F4 //500
 	RPCStatusLocalError       = 0x0266 //550
@@ -367,6 +414,11 @@ type WSRequest struct {
 	Progress        chan *WSRequestProgress
 	Response        chan *WebSocketResponseBody
 	Errors          []string
+	//cancel is closed by CancelRequest before Progress is closed, progressMu is held by anything sending on
+	//Progress so the channel is never closed under a send
+	cancelMu   sync.Mutex
+	cancel     chan struct{}
+	progressMu sync.RWMutex
 }
 
 func NewBasicWSRequest(requestID string, requestBody *WebSocketRequestBody) *WSRequest {
@@ -519,8 +571,85 @@ func NewWSHttpRequestWithAckTimeoutAndTimeout(requestID string, seshKey string,
 
 }
 
+// CancelSignal is closed once the request has been cancelled, unlike Cancelled it is safe to watch from other goroutines
+func (wsr *WSRequest) CancelSignal() <-chan struct{} {
+
+	wsr.cancelMu.Lock()
+	defer wsr.cancelMu.Unlock()
+
+	if wsr.cancel == nil {
+		wsr.cancel = make(chan struct{})
+	}
+
+	return wsr.cancel
+
+}
+
+func (wsr *WSRequest) isCancelled() bool {
+
+	select {
+	case <-wsr.CancelSignal():
+		return true
+	default:
+		return false
+	}
+
+}
+
+// sendProgress sends an update on Progress, waiting up to timeout for it to be read - with no timeout the update
+// is only sent if it is being read right now. Nothing is sent once the request has been cancelled.
+func (wsr *WSRequest) sendProgress(progress *WSRequestProgress, timeout time.Duration) bool {
+
+	wsr.progressMu.RLock()
+	defer wsr.progressMu.RUnlock()
+
+	cancel := wsr.CancelSignal()
+
+	select {
+	case <-cancel:
+		return false
+	default:
+	}
+
+	if timeout <= 0 {
+		select {
+		case wsr.Progress <- progress:
+			return true
+		default:
+			return false
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case wsr.Progress <- progress:
+		return true
+	case <-cancel:
+	case <-timer.C:
+	}
+
+	return false
+
+}
+
 func (wsr *WSRequest) CancelRequest() {
 
+	//wake anything waiting to send progress first, they hold progressMu until they give up
+
+	wsr.cancelMu.Lock()
+
+	if wsr.cancel == nil {
+		wsr.cancel = make(chan struct{})
+	}
+
+	close(wsr.cancel)
+
+	wsr.cancelMu.Unlock()
+
+	wsr.progressMu.Lock()
+
 	wsr.Cancelled = true
 
 	//add cancelled error to stack... response will be a payload signifying it
@@ -528,6 +657,8 @@ func (wsr *WSRequest) CancelRequest() {
 	wsr.Errors = append(wsr.Errors, "Request was cancelled.")
 	close(wsr.Progress)
 
+	wsr.progressMu.Unlock()
+
 	wsr.Done <- false
 	wsr.Response <- NewWSRequestCancelledResponse(wsr.requestID, wsr.seshKey)
 	close(wsr.Done)